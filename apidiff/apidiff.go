@@ -0,0 +1,282 @@
+// Package apidiff compares two versions of sherpadoc documentation of an API,
+// listing added, removed and changed sections, functions, types, fields and enum
+// values, and whether the changes break existing clients.
+package apidiff
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/mjl-/sherpadoc"
+)
+
+// Kind of change.
+type Kind string
+
+const (
+	Added   Kind = "added"
+	Removed Kind = "removed"
+	Changed Kind = "changed"
+)
+
+// Change is a single difference between two versions of an API.
+type Change struct {
+	Kind     Kind
+	Breaking bool   // Whether the change breaks existing clients or servers.
+	What     string // E.g. "function sum", "field Name of struct Item".
+	Message  string // Optional explanation, e.g. the old and new types.
+}
+
+// String returns a line describing the change, starting with "breaking: " for
+// breaking changes.
+func (c Change) String() string {
+	s := string(c.Kind) + " " + c.What
+	if c.Message != "" {
+		s += ": " + c.Message
+	}
+	if c.Breaking {
+		s = "breaking: " + s
+	}
+	return s
+}
+
+// Breaking returns whether any of the changes is breaking.
+func Breaking(changes []Change) bool {
+	return slices.ContainsFunc(changes, func(c Change) bool { return c.Breaking })
+}
+
+// Compare returns the changes from API documentation old to new.
+//
+// Functions and types are compared by name, regardless of the section they are
+// in. Breaking changes are: removed functions, types, struct fields and enum
+// values; changed number of parameters or return values; changed types of
+// parameters, return values and struct fields, except for parameters becoming
+// nullable and return values becoming non-nullable; changed enum values.
+// Added and removed sections are not breaking by themselves, but the functions
+// and types they contain are compared.
+func Compare(old, new *sherpadoc.Section) []Change {
+	var changes []Change
+	add := func(kind Kind, breaking bool, what, format string, args ...any) {
+		changes = append(changes, Change{kind, breaking, what, fmt.Sprintf(format, args...)})
+	}
+
+	// Sections, by path of section names.
+	oldSections := gatherSections(nil, "", old)
+	newSections := gatherSections(nil, "", new)
+	for _, s := range oldSections {
+		if !slices.Contains(newSections, s) {
+			add(Removed, false, "section "+s, "")
+		}
+	}
+	for _, s := range newSections {
+		if !slices.Contains(oldSections, s) {
+			add(Added, false, "section "+s, "")
+		}
+	}
+
+	// Functions.
+	oldFunctions := gatherFunctions(nil, "", old)
+	newFunctions := gatherFunctions(nil, "", new)
+	newFunctionsMap := map[string]function{}
+	for _, f := range newFunctions {
+		newFunctionsMap[f.Name] = f
+	}
+	oldFunctionsMap := map[string]function{}
+	for _, of := range oldFunctions {
+		oldFunctionsMap[of.Name] = of
+		what := "function " + of.Name
+		nf, ok := newFunctionsMap[of.Name]
+		if !ok {
+			add(Removed, true, what, "")
+			continue
+		}
+		if of.section != nf.section {
+			add(Changed, false, what, "moved from section %s to %s", of.section, nf.section)
+		}
+		compareArgs(add, what, "parameter", of.Params, nf.Params, true)
+		compareArgs(add, what, "return value", of.Returns, nf.Returns, false)
+	}
+	for _, nf := range newFunctions {
+		if _, ok := oldFunctionsMap[nf.Name]; !ok {
+			add(Added, false, "function "+nf.Name, "")
+		}
+	}
+
+	// Types.
+	oldTypes := gatherTypes(nil, old)
+	newTypes := gatherTypes(nil, new)
+	newTypesMap := map[string]namedType{}
+	for _, t := range newTypes {
+		newTypesMap[t.name] = t
+	}
+	oldTypesMap := map[string]namedType{}
+	for _, ot := range oldTypes {
+		oldTypesMap[ot.name] = ot
+		what := ot.kind + " " + ot.name
+		nt, ok := newTypesMap[ot.name]
+		if !ok {
+			add(Removed, true, what, "")
+			continue
+		}
+		if ot.kind != nt.kind {
+			add(Changed, true, what, "changed from %s to %s", ot.kind, nt.kind)
+			continue
+		}
+		switch ot.kind {
+		case "struct":
+			compareFields(add, what, ot.fields, nt.fields)
+		default:
+			compareValues(add, what, ot.values, nt.values)
+		}
+	}
+	for _, nt := range newTypes {
+		if _, ok := oldTypesMap[nt.name]; !ok {
+			add(Added, false, nt.kind+" "+nt.name, "")
+		}
+	}
+
+	return changes
+}
+
+type function struct {
+	*sherpadoc.Function
+	section string
+}
+
+type namedType struct {
+	kind   string // "struct", "ints" or "strings".
+	name   string
+	fields []sherpadoc.Field
+	values []enumValue // For ints and strings.
+}
+
+type enumValue struct {
+	name  string
+	value string // JSON-encoded value.
+}
+
+func sectionPath(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "/" + name
+}
+
+func gatherSections(l []string, parent string, sec *sherpadoc.Section) []string {
+	for _, subsec := range sec.Sections {
+		path := sectionPath(parent, subsec.Name)
+		l = append(l, path)
+		l = gatherSections(l, path, subsec)
+	}
+	return l
+}
+
+func gatherFunctions(l []function, parent string, sec *sherpadoc.Section) []function {
+	path := sectionPath(parent, sec.Name)
+	for _, fn := range sec.Functions {
+		l = append(l, function{fn, path})
+	}
+	for _, subsec := range sec.Sections {
+		l = gatherFunctions(l, path, subsec)
+	}
+	return l
+}
+
+func gatherTypes(l []namedType, sec *sherpadoc.Section) []namedType {
+	for _, t := range sec.Structs {
+		l = append(l, namedType{kind: "struct", name: t.Name, fields: t.Fields})
+	}
+	for _, t := range sec.Ints {
+		nt := namedType{kind: "ints", name: t.Name}
+		for _, v := range t.Values {
+			nt.values = append(nt.values, enumValue{v.Name, fmt.Sprintf("%d", v.Value)})
+		}
+		l = append(l, nt)
+	}
+	for _, t := range sec.Strings {
+		nt := namedType{kind: "strings", name: t.Name}
+		for _, v := range t.Values {
+			nt.values = append(nt.values, enumValue{v.Name, fmt.Sprintf("%q", v.Value)})
+		}
+		l = append(l, nt)
+	}
+	for _, subsec := range sec.Sections {
+		l = gatherTypes(l, subsec)
+	}
+	return l
+}
+
+func typeString(typewords []string) string {
+	return strings.Join(typewords, " ")
+}
+
+// compareArgs compares parameters or return values. For parameters (isParam),
+// becoming nullable is not breaking: old clients never send null. For return
+// values, becoming non-nullable is not breaking: old clients still handle the
+// non-null values.
+func compareArgs(add func(Kind, bool, string, string, ...any), what, argKind string, old, new []sherpadoc.Arg, isParam bool) {
+	if len(old) != len(new) {
+		add(Changed, true, what, "number of %ss changed from %d to %d", argKind, len(old), len(new))
+	}
+	for i := 0; i < len(old) && i < len(new); i++ {
+		ot, nt := old[i].Typewords, new[i].Typewords
+		if slices.Equal(ot, nt) {
+			continue
+		}
+		breaking := true
+		if isParam && len(nt) > 0 && nt[0] == "nullable" && slices.Equal(nt[1:], ot) {
+			breaking = false
+		} else if !isParam && len(ot) > 0 && ot[0] == "nullable" && slices.Equal(ot[1:], nt) {
+			breaking = false
+		}
+		msg := fmt.Sprintf("type of %s %d (%s) changed from %q to %q", argKind, i, new[i].Name, typeString(ot), typeString(nt))
+		if isParam && len(ot) > 0 && ot[0] == "nullable" && slices.Equal(ot[1:], nt) {
+			msg += ", nullable became non-nullable"
+		} else if !isParam && len(nt) > 0 && nt[0] == "nullable" && slices.Equal(nt[1:], ot) {
+			msg += ", non-nullable became nullable"
+		}
+		add(Changed, breaking, what, "%s", msg)
+	}
+}
+
+// compareFields compares fields of a struct. Structs can be used in both
+// parameters and return values, so any change in type is breaking.
+func compareFields(add func(Kind, bool, string, string, ...any), what string, old, new []sherpadoc.Field) {
+	for _, of := range old {
+		i := slices.IndexFunc(new, func(f sherpadoc.Field) bool { return f.Name == of.Name })
+		if i < 0 {
+			add(Removed, true, "field "+of.Name+" of "+what, "")
+			continue
+		}
+		nf := new[i]
+		if !slices.Equal(of.Typewords, nf.Typewords) {
+			msg := fmt.Sprintf("type changed from %q to %q", typeString(of.Typewords), typeString(nf.Typewords))
+			if len(of.Typewords) > 0 && of.Typewords[0] == "nullable" && slices.Equal(of.Typewords[1:], nf.Typewords) {
+				msg += ", nullable became non-nullable"
+			}
+			add(Changed, true, "field "+of.Name+" of "+what, "%s", msg)
+		}
+	}
+	for _, nf := range new {
+		if !slices.ContainsFunc(old, func(f sherpadoc.Field) bool { return f.Name == nf.Name }) {
+			add(Added, false, "field "+nf.Name+" of "+what, "")
+		}
+	}
+}
+
+func compareValues(add func(Kind, bool, string, string, ...any), what string, old, new []enumValue) {
+	for _, ov := range old {
+		i := slices.IndexFunc(new, func(v enumValue) bool { return v.name == ov.name })
+		if i < 0 {
+			add(Removed, true, "value "+ov.name+" of "+what, "")
+		} else if new[i].value != ov.value {
+			add(Changed, true, "value "+ov.name+" of "+what, "changed from %s to %s", ov.value, new[i].value)
+		}
+	}
+	for _, nv := range new {
+		if !slices.ContainsFunc(old, func(v enumValue) bool { return v.name == nv.name }) {
+			add(Added, false, "value "+nv.name+" of "+what, "")
+		}
+	}
+}
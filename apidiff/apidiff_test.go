@@ -0,0 +1,67 @@
+package apidiff
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mjl-/sherpadoc"
+)
+
+func TestCompare(t *testing.T) {
+	old := &sherpadoc.Section{
+		Name: "API",
+		Functions: []*sherpadoc.Function{
+			{Name: "get", Params: []sherpadoc.Arg{{Name: "id", Typewords: []string{"int64"}}}, Returns: []sherpadoc.Arg{{Name: "r", Typewords: []string{"nullable", "Item"}}}},
+			{Name: "put", Params: []sherpadoc.Arg{{Name: "item", Typewords: []string{"Item"}}}},
+			{Name: "remove", Params: []sherpadoc.Arg{{Name: "id", Typewords: []string{"int64"}}}},
+		},
+		Structs: []sherpadoc.Struct{
+			{Name: "Item", Fields: []sherpadoc.Field{
+				{Name: "Name", Typewords: []string{"nullable", "string"}},
+				{Name: "Old", Typewords: []string{"bool"}},
+			}},
+		},
+	}
+	new := &sherpadoc.Section{
+		Name: "API",
+		Functions: []*sherpadoc.Function{
+			{Name: "get", Params: []sherpadoc.Arg{{Name: "id", Typewords: []string{"nullable", "int64"}}}, Returns: []sherpadoc.Arg{{Name: "r", Typewords: []string{"Item"}}}},
+			{Name: "put", Params: []sherpadoc.Arg{{Name: "item", Typewords: []string{"Item"}}, {Name: "force", Typewords: []string{"bool"}}}},
+			{Name: "list"},
+		},
+		Structs: []sherpadoc.Struct{
+			{Name: "Item", Fields: []sherpadoc.Field{
+				{Name: "Name", Typewords: []string{"string"}},
+				{Name: "New", Typewords: []string{"bool"}},
+			}},
+		},
+		Sections: []*sherpadoc.Section{{Name: "Admin"}},
+	}
+
+	changes := Compare(old, new)
+	var lines []string
+	for _, c := range changes {
+		lines = append(lines, c.String())
+	}
+	got := strings.Join(lines, "\n")
+	exp := strings.Join([]string{
+		`added section Admin`,
+		`changed function get: type of parameter 0 (id) changed from "int64" to "nullable int64"`,
+		`changed function get: type of return value 0 (r) changed from "nullable Item" to "Item"`,
+		`breaking: changed function put: number of parameters changed from 1 to 2`,
+		`breaking: removed function remove`,
+		`added function list`,
+		`breaking: changed field Name of struct Item: type changed from "nullable string" to "string", nullable became non-nullable`,
+		`breaking: removed field Old of struct Item`,
+		`added field New of struct Item`,
+	}, "\n")
+	if got != exp {
+		t.Fatalf("changes:\n%s\n\nexpected:\n%s", got, exp)
+	}
+	if !Breaking(changes) {
+		t.Fatalf("breaking changes not detected")
+	}
+	if changes := Compare(old, old); len(changes) != 0 {
+		t.Fatalf("changes comparing with itself: %v", changes)
+	}
+}
@@ -0,0 +1,115 @@
+package sherpa
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// Call holds information about a function call, see CallInfo.
+type Call struct {
+	Function string          // Name of the function.
+	Params   json.RawMessage // Parameters as sent by the client, a JSON array.
+
+	// Request is the HTTP request of the call. Its body has already been read. For
+	// calls in a batch, the request is for the whole batch.
+	Request *http.Request
+
+	// ResponseHeader sets headers of the HTTP response.
+	ResponseHeader ResponseHeader
+}
+
+type callKey struct{}
+
+// CallInfo returns information about the function call from the context of a
+// function call, or nil if ctx is not from a function call. The handler adds the
+// information to the context of each call, after HandlerOpts.NewContext.
+func CallInfo(ctx context.Context) *Call {
+	c, _ := ctx.Value(callKey{}).(*Call)
+	return c
+}
+
+// ResponseHeader sets headers of the HTTP response of a function call, e.g. for
+// cookies. Headers must be set before the function returns, and, for streams,
+// before the stream is returned. For calls in a batch, the headers are set on the
+// response of the whole batch.
+//
+// Headers used by the sherpa protocol cannot be changed: Content-Type,
+// Content-Length, Content-Encoding, Transfer-Encoding and Cache-Control.
+type ResponseHeader struct {
+	h http.Header
+
+	// If not nil, the values of the headers changed through ResponseHeader are
+	// recorded, with nil for deleted headers. For storing responses with
+	// HandlerOpts.IdempotencyStore.
+	record http.Header
+}
+
+// changed records the current value of header key if needed.
+func (rh ResponseHeader) changed(key string) {
+	if rh.record != nil {
+		key = http.CanonicalHeaderKey(key)
+		rh.record[key] = slices.Clone(rh.h[key])
+	}
+}
+
+var protocolHeaders = map[string]bool{
+	"Content-Type":      true,
+	"Content-Length":    true,
+	"Content-Encoding":  true,
+	"Transfer-Encoding": true,
+	"Cache-Control":     true,
+}
+
+func (rh ResponseHeader) check(key string) error {
+	if protocolHeaders[http.CanonicalHeaderKey(key)] {
+		return fmt.Errorf("response header %q cannot be changed", key)
+	}
+	return nil
+}
+
+// Set sets header key to value, replacing existing values.
+func (rh ResponseHeader) Set(key, value string) error {
+	if err := rh.check(key); err != nil {
+		return err
+	}
+	rh.h.Set(key, value)
+	rh.changed(key)
+	return nil
+}
+
+// Add adds value to header key.
+func (rh ResponseHeader) Add(key, value string) error {
+	if err := rh.check(key); err != nil {
+		return err
+	}
+	rh.h.Add(key, value)
+	rh.changed(key)
+	return nil
+}
+
+// Del removes header key.
+func (rh ResponseHeader) Del(key string) error {
+	if err := rh.check(key); err != nil {
+		return err
+	}
+	rh.h.Del(key)
+	rh.changed(key)
+	return nil
+}
+
+// Get returns the first value for header key.
+func (rh ResponseHeader) Get(key string) string {
+	return rh.h.Get(key)
+}
+
+// SetCookie adds a Set-Cookie header. Invalid cookies are silently dropped, like
+// http.SetCookie does.
+func (rh ResponseHeader) SetCookie(cookie *http.Cookie) {
+	if v := cookie.String(); v != "" {
+		rh.h.Add("Set-Cookie", v)
+		rh.changed("Set-Cookie")
+	}
+}
@@ -1,11 +1,15 @@
 package client
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"sync"
 
 	"github.com/mjl-/sherpa"
 )
@@ -17,76 +21,276 @@ const (
 
 // Client lets you call functions from an existing Sherpa API.
 // If the API was initialized with a non-nil function list, some fields will be nil (as indicated).
+//
+// Fields must not be changed while calls are in progress.
 type Client struct {
-	BaseURL    string   // BaseURL the API is served from, e.g. https://www.sherpadoc.org/example/
-	Functions  []string // Function names exported by the API
-	JSON       *sherpa.JSON
-	HTTPClient *http.Client
+	BaseURL    string       // BaseURL the API is served from, e.g. https://www.sherpadoc.org/example/
+	Functions  []string     // Function names exported by the API
+	JSON       *sherpa.JSON // Nil if the API was initialized with a non-nil function list.
+	HTTPClient *http.Client // If nil, http.DefaultClient is used.
+
+	// Header is added to each request, e.g. for API keys. See WithHeader for
+	// headers for a single call.
+	Header http.Header
+
+	// UserAgent is sent as User-Agent header, if not empty.
+	UserAgent string
+
+	// BearerToken is sent in the Authorization header as bearer token, if not empty.
+	BearerToken string
+
+	// Username and Password are sent in the Authorization header with HTTP basic
+	// authentication, if Username is not empty.
+	Username string
+	Password string
+
+	// Retry, if not nil, retries failed calls to idempotent functions and calls
+	// with an idempotency key. See RetryPolicy.
+	Retry *RetryPolicy
+
+	// Names of functions to treat as idempotent for retries, in addition to those
+	// marked as idempotent by the API in sherpa.json.
+	Idempotent []string
+
+	// Description of the API from sherpa.json if JSON is nil, see apiJSON.
+	fetchMutex  sync.Mutex
+	fetched     bool
+	fetchedJSON *sherpa.JSON // Nil if sherpa.json could not be parsed.
 }
 
 // New makes a new sherpa Client, for the given URL.
 // If "functions" is nil, the API at the URL is contacted for a function list.
+//
+// To set options such as authentication before the API is contacted, call New
+// with a non-nil function list, set the options and call Fetch.
 func New(url string, functions []string) (*Client, error) {
 	c := &Client{BaseURL: url, Functions: functions, HTTPClient: http.DefaultClient}
 
 	if functions != nil {
 		return c, nil
 	}
+	if err := c.Fetch(context.Background()); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
 
-	resp, err := c.HTTPClient.Get(url + "sherpa.json")
+// Fetch retrieves the sherpa.json description of the API, and sets JSON and Functions.
+func (c *Client) Fetch(ctx context.Context) error {
+	req, err := c.newRequest(ctx, "GET", c.BaseURL+"sherpa.json", nil)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
 	}
 	defer resp.Body.Close()
 	switch resp.StatusCode {
 	case 200:
-		c.JSON = &sherpa.JSON{}
-		err = json.NewDecoder(resp.Body).Decode(c.JSON)
+		var xjson sherpa.JSON
+		err = json.NewDecoder(resp.Body).Decode(&xjson)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		if c.JSON.SherpaVersion != sherpa.SherpaVersion {
-			return nil, fmt.Errorf("remote API uses unsupported sherpa version %d", c.JSON.SherpaVersion)
+		if xjson.SherpaVersion != sherpa.SherpaVersion {
+			return fmt.Errorf("remote API uses unsupported sherpa version %d", xjson.SherpaVersion)
 		}
-		return c, nil
+		c.JSON = &xjson
+		c.Functions = xjson.Functions
+		return nil
 	case 404:
-		return nil, fmt.Errorf("no API found at URL %s", url)
+		return fmt.Errorf("no API found at URL %s", c.BaseURL)
 	default:
-		return nil, fmt.Errorf("unexpected HTTP response %s for URL %s", resp.Status, url)
+		return fmt.Errorf("unexpected HTTP response %s for URL %s", resp.Status, c.BaseURL)
+	}
+}
+
+type headerKey struct{}
+
+// WithHeader returns a context that adds the headers in h to requests for calls
+// made with the context. The headers replace headers with the same name set
+// through the Client, e.g. an Authorization header.
+func WithHeader(ctx context.Context, h http.Header) context.Context {
+	if prev, ok := ctx.Value(headerKey{}).(http.Header); ok {
+		xh := prev.Clone()
+		for k, v := range h {
+			xh[k] = v
+		}
+		h = xh
+	}
+	return context.WithValue(ctx, headerKey{}, h)
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+// newRequest returns a request with the headers and authentication configured
+// in the client and with WithHeader, and the trace context from ctx (see
+// sherpa.TraceContextFrom). Compressed responses are accepted. A JSON
+// content-type and CSRF token are set if body is not nil.
+func (c *Client) newRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.Header {
+		req.Header[k] = append([]string(nil), v...)
+	}
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	if tc, ok := sherpa.TraceContextFrom(ctx); ok {
+		req.Header.Set("traceparent", tc.TraceParent())
+		if tc.State != "" {
+			req.Header.Set("tracestate", tc.State)
+		}
 	}
+	if c.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.BearerToken)
+	} else if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	if h, ok := ctx.Value(headerKey{}).(http.Header); ok {
+		for k, v := range h {
+			req.Header[k] = append([]string(nil), v...)
+		}
+	}
+	if key, _ := ctx.Value(idempotencyKey{}).(string); key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	// Responses are decompressed by do.
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+		c.setCSRF(req)
+	}
+	return req, nil
+}
+
+// setCSRF adds the CSRF token required by the API, as published in sherpa.json,
+// to req. The token is taken from the cookie in the cookie jar of the HTTP
+// client. Without cookie, a token is added to both the header and a cookie.
+func (c *Client) setCSRF(req *http.Request) {
+	csrf := c.csrfConfig(req.Context())
+	if csrf == nil {
+		return
+	}
+	token := "sherpa"
+	if csrf.Cookie != "" {
+		var found bool
+		if jar := c.httpClient().Jar; jar != nil {
+			for _, cookie := range jar.Cookies(req.URL) {
+				if cookie.Name == csrf.Cookie {
+					token = cookie.Value
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			req.AddCookie(&http.Cookie{Name: csrf.Cookie, Value: token})
+		}
+	}
+	req.Header.Set(csrf.Header, token)
+}
+
+// csrfConfig returns the CSRF token configuration of the API, or nil if the API
+// does not require CSRF tokens. If sherpa.json cannot be fetched, the default
+// CSRF header is used, which works for APIs that require a token but no cookie.
+func (c *Client) csrfConfig(ctx context.Context) *sherpa.JSONCSRF {
+	xjson := c.apiJSON(ctx)
+	if xjson == nil {
+		return &sherpa.JSONCSRF{Header: "X-Sherpa-CSRF"}
+	}
+	return xjson.CSRF
+}
+
+// apiJSON returns the description of the API, or nil if it is not known. If JSON
+// was not fetched, e.g. for clients made with a function list, sherpa.json is
+// fetched on first use, without setting JSON. Fetching is tried again for later
+// calls after a network error.
+func (c *Client) apiJSON(ctx context.Context) *sherpa.JSON {
+	if c.JSON != nil {
+		return c.JSON
+	}
+
+	c.fetchMutex.Lock()
+	defer c.fetchMutex.Unlock()
+	if c.fetched {
+		return c.fetchedJSON
+	}
+	req, err := c.newRequest(ctx, "GET", c.BaseURL+"sherpa.json", nil)
+	if err != nil {
+		return nil
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	c.fetched = true
+	var xjson sherpa.JSON
+	if resp.StatusCode == 200 && json.NewDecoder(resp.Body).Decode(&xjson) == nil {
+		c.fetchedJSON = &xjson
+	}
+	return c.fetchedJSON
 }
 
 // Call an API function by name.
 //
+// Calls are made with POST, which all functions allow, regardless of the
+// methods published in sherpa.json, see sherpa.Methods. The request is canceled
+// when ctx is canceled or its deadline expires. Failed calls are retried
+// according to the Retry policy. A trace context in ctx, see
+// sherpa.WithTraceContext, is sent in the traceparent and tracestate headers.
+//
 // If error is not null, it is of type Error.
 // If result is null, no attempt is made to parse the "result" part of the sherpa response.
 func (c *Client) Call(ctx context.Context, result interface{}, functionName string, params ...interface{}) error {
 	req := map[string]interface{}{
 		"params": params,
 	}
-	buf := &bytes.Buffer{}
-	err := json.NewEncoder(buf).Encode(req)
+	buf, err := json.Marshal(req)
 	if err != nil {
 		return &sherpa.Error{Code: ClientEncodeErr, Message: "could not encode request parameters: " + err.Error()}
 	}
-	url := c.BaseURL + functionName
-	resp, err := c.HTTPClient.Post(url, "application/json", buf)
+	retry := c.retryable(ctx, functionName)
+	for attempt := 1; ; attempt++ {
+		err = c.call(ctx, result, functionName, buf)
+		if err == nil || !retry || !c.Retry.retry(ctx, attempt, err) {
+			return err
+		}
+	}
+}
+
+// call does a single attempt of a call with the JSON request body buf.
+func (c *Client) call(ctx context.Context, result interface{}, functionName string, buf []byte) error {
+	hreq, err := c.newRequest(ctx, "POST", c.BaseURL+functionName, bytes.NewReader(buf))
+	if err != nil {
+		return &sherpa.Error{Code: sherpa.SherpaHTTPError, Message: "making POST request: " + err.Error()}
+	}
+	resp, err := c.do(hreq)
 	if err != nil {
 		return &sherpa.Error{Code: sherpa.SherpaHTTPError, Message: "sending POST request: " + err.Error()}
 	}
+	defer resp.Body.Close()
 	switch resp.StatusCode {
 	case 200:
-		defer resp.Body.Close()
 		var response struct {
 			Result json.RawMessage `json:"result"`
-			Error  *sherpa.Error   `json:"error"`
+			Error  *jsonError      `json:"error"`
 		}
 		err = json.NewDecoder(resp.Body).Decode(&response)
 		if err != nil {
 			return &sherpa.Error{Code: sherpa.SherpaBadResponse, Message: "could not parse JSON response: " + err.Error()}
 		}
 		if response.Error != nil {
-			return response.Error
+			return response.Error.error()
 		}
 		if result != nil {
 			err = json.Unmarshal(response.Result, result)
@@ -98,6 +302,165 @@ func (c *Client) Call(ctx context.Context, result interface{}, functionName stri
 	case 404:
 		return &sherpa.Error{Code: sherpa.SherpaBadFunction, Message: "no such function"}
 	default:
-		return &sherpa.Error{Code: sherpa.SherpaHTTPError, Message: "HTTP error from server: " + resp.Status}
+		return httpError(resp)
+	}
+}
+
+// jsonError is an error in a sherpa response, with details kept as JSON.
+type jsonError struct {
+	Code    string          `json:"code"`
+	Message string          `json:"message"`
+	Details json.RawMessage `json:"details"`
+}
+
+func (e *jsonError) error() *sherpa.Error {
+	se := &sherpa.Error{Code: e.Code, Message: e.Message}
+	if len(e.Details) > 0 && string(e.Details) != "null" {
+		se.Details = e.Details
+	}
+	return se
+}
+
+// httpError returns the sherpa error from the response body of a request that
+// failed with an HTTP error status, e.g. for authorization errors. If the body
+// does not contain a sherpa error, a SherpaHTTPError is returned.
+func httpError(resp *http.Response) error {
+	var response struct {
+		Error *jsonError `json:"error"`
+	}
+	if mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mt == "application/json" {
+		if err := json.NewDecoder(resp.Body).Decode(&response); err == nil && response.Error != nil {
+			return response.Error.error()
+		}
+	}
+	return &sherpa.Error{Code: sherpa.SherpaHTTPError, Message: "HTTP error from server: " + resp.Status}
+}
+
+// BatchCall is a single function call in a batch, see Client.Batch.
+type BatchCall struct {
+	Function string        // Name of the function to call.
+	Params   []interface{} // Parameters for the function.
+	Result   interface{}   // If not nil, the result of a successful call is unmarshaled into it.
+	Error    error         // Set by Batch. Nil if the call succeeded, of type *sherpa.Error otherwise.
+}
+
+// Batch calls multiple API functions in a single HTTP request, through the
+// "_batch" endpoint of the API.
+//
+// The returned error is only set if the batch request as a whole failed. Errors
+// for individual calls are set in their Error field.
+func (c *Client) Batch(ctx context.Context, calls []*BatchCall) error {
+	type call struct {
+		Function string        `json:"function"`
+		Params   []interface{} `json:"params"`
+	}
+	xcalls := make([]call, len(calls))
+	for i, bc := range calls {
+		params := bc.Params
+		if params == nil {
+			params = []interface{}{}
+		}
+		xcalls[i] = call{bc.Function, params}
+	}
+
+	var results []struct {
+		Result json.RawMessage `json:"result"`
+		Error  *jsonError      `json:"error"`
+	}
+	err := c.Call(ctx, &results, "_batch", xcalls)
+	if err != nil {
+		return err
+	}
+	if len(results) != len(calls) {
+		return &sherpa.Error{Code: sherpa.SherpaBadResponse, Message: fmt.Sprintf("batch response has %d results, expected %d", len(results), len(calls))}
+	}
+	for i, bc := range calls {
+		bc.Error = nil
+		if results[i].Error != nil {
+			bc.Error = results[i].Error.error()
+		} else if bc.Result != nil {
+			err = json.Unmarshal(results[i].Result, bc.Result)
+			if err != nil {
+				bc.Error = &sherpa.Error{Code: sherpa.SherpaBadResponse, Message: "could not unmarshal JSON response"}
+			}
+		}
+	}
+	return nil
+}
+
+// Stream calls an API function that returns a stream of results.
+//
+// For each result, fn is called with the JSON-encoded result. If fn returns an
+// error, the stream is stopped and the error returned. Cancel ctx to stop
+// receiving results. If the function returns a regular (non-stream) result, fn is
+// called once with that result.
+//
+// If error is not nil and not returned by fn, it is of type *sherpa.Error.
+func (c *Client) Stream(ctx context.Context, fn func(result json.RawMessage) error, functionName string, params ...interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+	buf := &bytes.Buffer{}
+	err := json.NewEncoder(buf).Encode(map[string]interface{}{"params": params})
+	if err != nil {
+		return &sherpa.Error{Code: ClientEncodeErr, Message: "could not encode request parameters: " + err.Error()}
+	}
+	req, err := c.newRequest(ctx, "POST", c.BaseURL+functionName, buf)
+	if err != nil {
+		return &sherpa.Error{Code: sherpa.SherpaHTTPError, Message: "making POST request: " + err.Error()}
+	}
+	req.Header.Set("Accept", "application/x-ndjson")
+	resp, err := c.do(req)
+	if err != nil {
+		return &sherpa.Error{Code: sherpa.SherpaHTTPError, Message: "sending POST request: " + err.Error()}
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case 200:
+	case 404:
+		return &sherpa.Error{Code: sherpa.SherpaBadFunction, Message: "no such function"}
+	default:
+		return httpError(resp)
+	}
+
+	type message struct {
+		Result json.RawMessage `json:"result"`
+		End    bool            `json:"end"`
+		Error  *jsonError      `json:"error"`
+	}
+
+	if mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mt != "application/x-ndjson" {
+		var m message
+		err = json.NewDecoder(resp.Body).Decode(&m)
+		if err != nil {
+			return &sherpa.Error{Code: sherpa.SherpaBadResponse, Message: "could not parse JSON response: " + err.Error()}
+		}
+		if m.Error != nil {
+			return m.Error.error()
+		}
+		return fn(m.Result)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		var m message
+		err = json.Unmarshal(scanner.Bytes(), &m)
+		if err != nil {
+			return &sherpa.Error{Code: sherpa.SherpaBadResponse, Message: "could not parse JSON stream message: " + err.Error()}
+		}
+		if m.End {
+			if m.Error != nil {
+				return m.Error.error()
+			}
+			return nil
+		}
+		if err := fn(m.Result); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return &sherpa.Error{Code: sherpa.SherpaHTTPError, Message: "reading stream: " + err.Error()}
 	}
+	return &sherpa.Error{Code: sherpa.SherpaBadResponse, Message: "stream ended without end message"}
 }
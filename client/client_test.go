@@ -0,0 +1,200 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mjl-/sherpa"
+	"github.com/mjl-/sherpadoc"
+)
+
+type exampleAPI struct{}
+
+func (exampleAPI) Echo(ctx context.Context) (string, string) {
+	req := ctx.Value(requestKey{}).(*http.Request)
+	return req.Header.Get("Authorization"), req.Header.Get("X-Test")
+}
+
+func (exampleAPI) Fail() error {
+	return &sherpa.Error{Code: "user:fail", Message: "failed", Details: map[string]int{"n": 1}}
+}
+
+func (exampleAPI) Trace(ctx context.Context) string {
+	tc, _ := sherpa.TraceContextFrom(ctx)
+	return tc.TraceParent()
+}
+
+func (exampleAPI) Sleep(ctx context.Context) {
+	<-ctx.Done()
+}
+
+type requestKey struct{}
+
+func TestClient(t *testing.T) {
+	opts := &sherpa.HandlerOpts{
+		NewContext: func(req *http.Request, method string, params []any) context.Context {
+			return context.WithValue(req.Context(), requestKey{}, req)
+		},
+		CSRF:            &sherpa.CSRF{Cookie: "csrf"},
+		CompressMinSize: 1, // Compress all responses, so the client must decompress.
+	}
+	h, err := sherpa.NewHandler("/", "0.0.1", exampleAPI{}, &sherpadoc.Section{}, opts)
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	c, err := New(s.URL+"/", []string{})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	c.Header = http.Header{"X-Test": []string{"client"}}
+	c.Username = "user"
+	c.Password = "pass"
+	if err := c.Fetch(context.Background()); err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if len(c.Functions) != 5 {
+		t.Fatalf("got functions %v, expected 5", c.Functions)
+	}
+
+	var r []string
+	if err := c.Call(context.Background(), &r, "echo"); err != nil {
+		t.Fatalf("call: %v", err)
+	} else if r[0] != "Basic dXNlcjpwYXNz" || r[1] != "client" {
+		t.Fatalf("got %v, expected basic auth and client header", r)
+	}
+
+	// Clients made with a function list fetch the CSRF configuration when needed.
+	xc, err := New(s.URL+"/", []string{})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := xc.Call(context.Background(), &r, "echo"); err != nil {
+		t.Fatalf("call without fetched sherpa.json: %v", err)
+	}
+
+	docs, err := c.Docs(context.Background())
+	if err != nil || docs.Version != "0.0.1" {
+		t.Fatalf("docs: got %v, %v, expected version 0.0.1", docs, err)
+	}
+	path := filepath.Join(t.TempDir(), "docs.json")
+	if buf, err := json.Marshal(docs); err != nil {
+		t.Fatalf("marshal docs: %v", err)
+	} else if err := os.WriteFile(path, buf, 0o600); err != nil {
+		t.Fatalf("writing docs: %v", err)
+	}
+	if docs, err := LoadDocs(context.Background(), path); err != nil || docs.Version != "0.0.1" {
+		t.Fatalf("load docs from file: got %v, %v", docs, err)
+	}
+
+	c.BearerToken = "token"
+	ctx := WithHeader(context.Background(), http.Header{"X-Test": []string{"call"}})
+	if err := c.Call(ctx, &r, "echo"); err != nil {
+		t.Fatalf("call: %v", err)
+	} else if r[0] != "Bearer token" || r[1] != "call" {
+		t.Fatalf("got %v, expected bearer token and per-call header", r)
+	}
+
+	tc, err := sherpa.ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil {
+		t.Fatalf("parse traceparent: %v", err)
+	}
+	var traceparent string
+	if err := c.Call(sherpa.WithTraceContext(context.Background(), tc), &traceparent, "trace"); err != nil {
+		t.Fatalf("call: %v", err)
+	} else if traceparent != tc.TraceParent() {
+		t.Fatalf("got traceparent %q, expected %q", traceparent, tc.TraceParent())
+	}
+
+	err = c.Call(context.Background(), nil, "fail")
+	var serr *sherpa.Error
+	if !errors.As(err, &serr) || serr.Code != "user:fail" {
+		t.Fatalf("got error %v, expected user:fail", err)
+	} else if details, ok := serr.Details.(json.RawMessage); !ok || string(details) != `{"n":1}` {
+		t.Fatalf("got details %#v, expected json", serr.Details)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = c.Call(ctx, nil, "sleep")
+	if !errors.As(err, &serr) || serr.Code != sherpa.SherpaHTTPError || ctx.Err() == nil {
+		t.Fatalf("got error %v, expected http error after deadline", err)
+	}
+}
+
+type retryAPI struct{}
+
+func (retryAPI) Get()    {}
+func (retryAPI) Charge() {}
+
+func TestRetry(t *testing.T) {
+	opts := &sherpa.HandlerOpts{
+		Functions:        map[string]sherpa.FunctionOpts{"get": {Idempotent: true}},
+		IdempotencyStore: sherpa.NewMemoryIdempotencyStore(time.Minute),
+	}
+	h, err := sherpa.NewHandler("/", "0.0.1", retryAPI{}, &sherpadoc.Section{}, opts)
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+	// Fail every other POST request with a bad gateway response.
+	var requests, posts int
+	var key string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		key = r.Header.Get("Idempotency-Key")
+		if r.Method == "POST" {
+			posts++
+		}
+		if r.Method == "POST" && posts%2 == 1 {
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	c, err := New(s.URL+"/", nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	c.Retry = &RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}
+
+	test := func(ctx context.Context, fn string, expRequests int, expErr bool) {
+		t.Helper()
+		requests, posts = 0, 0
+		err := c.Call(ctx, nil, fn)
+		if (err != nil) != expErr || requests != expRequests {
+			t.Fatalf("call %s: got error %v after %d requests, expected error %v after %d", fn, err, requests, expErr, expRequests)
+		}
+	}
+	test(context.Background(), "get", 2, false)
+	test(context.Background(), "charge", 1, true)
+	test(WithIdempotencyKey(context.Background(), "k1"), "charge", 2, false)
+	if key != "k1" {
+		t.Fatalf("got idempotency key %q, expected k1", key)
+	}
+
+	// Clients made with a function list fetch sherpa.json to find out if the API
+	// supports idempotency keys. Without IdempotencyStore, calls with a key are not
+	// retried.
+	h, err = sherpa.NewHandler("/", "0.0.1", retryAPI{}, &sherpadoc.Section{}, &sherpa.HandlerOpts{Functions: opts.Functions})
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+	c, err = New(s.URL+"/", []string{})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	c.Retry = &RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}
+	test(WithIdempotencyKey(context.Background(), "k2"), "charge", 2, true) // Request for sherpa.json and failed call.
+	test(context.Background(), "get", 2, false)
+}
@@ -0,0 +1,54 @@
+package client
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// do sends req and returns the response, with the body decompressed if the
+// server compressed it with gzip or deflate, see newRequest.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch enc := strings.ToLower(resp.Header.Get("Content-Encoding")); enc {
+	case "gzip", "deflate":
+		resp.Body = &decodedBody{body: resp.Body, encoding: enc}
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		resp.Uncompressed = true
+	}
+	return resp, nil
+}
+
+// decodedBody decompresses a response body. The decompressor is created on
+// first read, so closing a body that was never read does not block.
+type decodedBody struct {
+	body     io.ReadCloser
+	encoding string // "gzip" or "deflate".
+	r        io.Reader
+	err      error
+}
+
+func (b *decodedBody) Read(buf []byte) (int, error) {
+	if b.r == nil && b.err == nil {
+		if b.encoding == "gzip" {
+			b.r, b.err = gzip.NewReader(b.body)
+		} else {
+			b.r, b.err = zlib.NewReader(b.body)
+		}
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.r.Read(buf)
+}
+
+func (b *decodedBody) Close() error {
+	return b.body.Close()
+}
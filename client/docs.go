@@ -0,0 +1,51 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mjl-/sherpadoc"
+)
+
+// Docs is the documentation of an API as returned by its "_docs" function: the
+// sherpadoc documentation with the error codes declared for functions.
+type Docs struct {
+	sherpadoc.Section
+	Errors map[string][]string `json:",omitempty"` // Keyed by function name.
+}
+
+// Docs fetches the documentation of the API by calling its "_docs" function.
+func (c *Client) Docs(ctx context.Context) (*Docs, error) {
+	var docs Docs
+	if err := c.Call(ctx, &docs, "_docs"); err != nil {
+		return nil, fmt.Errorf("fetching documentation: %w", err)
+	}
+	return &docs, nil
+}
+
+// LoadDocs returns the documentation from source: the URL of a sherpa API
+// (starting with http:// or https://), or a file with JSON documentation, as
+// generated by sherpadoc or returned by the "_docs" function.
+func LoadDocs(ctx context.Context, source string) (*Docs, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		c, err := New(source, []string{})
+		if err != nil {
+			return nil, err
+		}
+		return c.Docs(ctx)
+	}
+
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var docs Docs
+	if err := json.NewDecoder(f).Decode(&docs); err != nil {
+		return nil, fmt.Errorf("parsing documentation: %w", err)
+	}
+	return &docs, nil
+}
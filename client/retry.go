@@ -0,0 +1,130 @@
+package client
+
+import (
+	"context"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	"github.com/mjl-/sherpa"
+)
+
+// RetryPolicy configures retrying of failed calls, see Client.Retry.
+//
+// Calls are only retried automatically if they are safe to repeat: when the
+// function is idempotent, or when the call has an idempotency key and the API
+// supports idempotency keys according to its sherpa.json, see
+// WithIdempotencyKey.
+type RetryPolicy struct {
+	// Maximum number of attempts, including the first. Values below 2 disable retries.
+	MaxAttempts int
+
+	// Delay before the first retry, doubled for each next retry up to MaxBackoff.
+	// Defaults to 100ms.
+	InitialBackoff time.Duration
+
+	// Maximum delay between attempts. Defaults to 10s.
+	MaxBackoff time.Duration
+
+	// Fraction of the delay that is randomized, between 0 and 1, to prevent
+	// clients from retrying in lockstep. E.g. with 0.5, a delay of 1s becomes a
+	// random delay between 0.5s and 1s. Defaults to 0.2. Negative values disable
+	// jitter.
+	Jitter float64
+
+	// Whether a failed call should be retried. If nil, DefaultRetryable is used.
+	Retryable func(err *sherpa.Error) bool
+}
+
+// DefaultRetryable returns whether err is a SherpaHTTPError, i.e. a network error
+// or an HTTP error status without sherpa error, e.g. from a proxy, or a
+// SherpaIdempotencyInProgress error.
+func DefaultRetryable(err *sherpa.Error) bool {
+	return err.Code == sherpa.SherpaHTTPError || err.Code == sherpa.SherpaIdempotencyInProgress
+}
+
+// backoff returns the delay after the failed attempt, starting at 1.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.InitialBackoff
+	if d <= 0 {
+		d = 100 * time.Millisecond
+	}
+	max := p.MaxBackoff
+	if max <= 0 {
+		max = 10 * time.Second
+	}
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	jitter := p.Jitter
+	if jitter == 0 {
+		jitter = 0.2
+	}
+	if jitter > 0 {
+		d -= time.Duration(float64(d) * min(jitter, 1) * rand.Float64())
+	}
+	return d
+}
+
+// retry returns whether a call should be attempted again after attempt failed
+// with err, and waits for the backoff. False is returned if ctx is done while
+// waiting.
+func (p *RetryPolicy) retry(ctx context.Context, attempt int, err error) bool {
+	serr, ok := err.(*sherpa.Error)
+	if !ok || attempt >= p.MaxAttempts || ctx.Err() != nil {
+		return false
+	}
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = DefaultRetryable
+	}
+	if !retryable(serr) {
+		return false
+	}
+	t := time.NewTimer(p.backoff(attempt))
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+type idempotencyKey struct{}
+
+// WithIdempotencyKey returns a context that sends key in the Idempotency-Key
+// header for calls made with it. A server that supports idempotency keys executes
+// the call only once, and returns the stored response for repeated requests with
+// the same key. Calls with an idempotency key can be retried, see RetryPolicy.
+//
+// Use a new unique key for each logical call, and the same context for its
+// retries.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey{}, key)
+}
+
+// retryable returns whether calls to functionName can be retried: with a retry
+// policy, for idempotent functions, and for calls with an idempotency key if the
+// API is known to support them from sherpa.json. Without confirmation a call
+// with an idempotency key is not retried: a server that ignores the key would
+// execute it again.
+func (c *Client) retryable(ctx context.Context, functionName string) bool {
+	if c.Retry == nil || c.Retry.MaxAttempts < 2 {
+		return false
+	}
+	if slices.Contains(c.Idempotent, functionName) {
+		return true
+	}
+	xjson := c.apiJSON(ctx)
+	if xjson == nil {
+		return false
+	}
+	if key, _ := ctx.Value(idempotencyKey{}).(string); key != "" && xjson.IdempotencyKeys {
+		return true
+	}
+	return slices.Contains(xjson.Idempotent, functionName)
+}
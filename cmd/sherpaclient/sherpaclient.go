@@ -12,6 +12,9 @@ Example:
 	# call a function
 	sherpaclient https://www.sherpadoc.org/example/ sum 1 1
 
+	# OpenAPI 3.1 document for the API
+	sherpaclient -openapi https://www.sherpadoc.org/example/
+
 The parameters to a function must be valid JSON. Don't forget to quote the double quotes of your JSON strings!
 
 	Usage: sherpaclient [options] baseURL function [param ...]
@@ -19,6 +22,8 @@ The parameters to a function must be valid JSON. Don't forget to quote the doubl
 		show documentation for all functions or single function if specified
 	  -info
 		show the API descriptor
+	  -openapi
+		print an OpenAPI 3.1 document for the API
 */
 package main
 
@@ -29,15 +34,18 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/mjl-/sherpa"
 	"github.com/mjl-/sherpa/client"
+	"github.com/mjl-/sherpa/openapi"
 	"github.com/mjl-/sherpadoc"
 )
 
 var (
-	printDoc  = flag.Bool("doc", false, "show documentation for all functions or single function if specified")
-	printInfo = flag.Bool("info", false, "show the API descriptor")
+	printDoc     = flag.Bool("doc", false, "show documentation for all functions or single function if specified")
+	printInfo    = flag.Bool("info", false, "show the API descriptor")
+	printOpenAPI = flag.Bool("openapi", false, "print an OpenAPI 3.1 document for the API")
 )
 
 func main() {
@@ -74,6 +82,15 @@ func main() {
 		return
 	}
 
+	if *printOpenAPI {
+		if len(args) != 0 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		printOpenAPIDoc(url)
+		return
+	}
+
 	if len(args) < 1 {
 		flag.Usage()
 		os.Exit(2)
@@ -132,37 +149,68 @@ func doc(url string, args []string) {
 		log.Fatal(err)
 	}
 
-	var doc sherpadoc.Section
-	cerr := c.Call(context.Background(), &doc, "_docs")
-	if cerr != nil {
-		log.Fatalf("fetching documentation: %s\n", cerr)
+	doc, err := c.Docs(context.Background())
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	if len(args) == 1 {
-		printFunction(&doc, args[0])
+		printFunction(&doc.Section, doc.Errors, args[0])
 	} else {
-		printSection(&doc)
+		printSection(&doc.Section, doc.Errors)
 	}
 }
 
-func printFunction(doc *sherpadoc.Section, function string) {
+func printOpenAPIDoc(url string) {
+	c, err := client.New(url, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	doc, err := c.Docs(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	apidoc, err := openapi.Convert(&doc.Section, openapi.Opts{BaseURL: c.JSON.BaseURL, Errors: doc.Errors})
+	if err != nil {
+		log.Fatalf("converting to openapi: %s", err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	err = enc.Encode(apidoc)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func printFunction(doc *sherpadoc.Section, errors map[string][]string, function string) {
 	for _, fn := range doc.Functions {
 		if fn.Name == function {
 			fmt.Println(fn.Docs)
+			printErrors(errors[fn.Name])
 		}
 	}
 	for _, subSec := range doc.Sections {
-		printFunction(subSec, function)
+		printFunction(subSec, errors, function)
 	}
 }
 
-func printSection(sec *sherpadoc.Section) {
+func printSection(sec *sherpadoc.Section, errors map[string][]string) {
 	fmt.Printf("# %s\n\n%s\n\n", sec.Name, sec.Docs)
 	for _, fn := range sec.Functions {
-		fmt.Printf("# %s()\n%s\n\n", fn.Name, fn.Docs)
+		fmt.Printf("# %s()\n%s\n", fn.Name, fn.Docs)
+		printErrors(errors[fn.Name])
+		fmt.Println("")
 	}
 	for _, subSec := range sec.Sections {
-		printSection(subSec)
+		printSection(subSec, errors)
 	}
 	fmt.Println("")
 }
+
+func printErrors(codes []string) {
+	if len(codes) > 0 {
+		fmt.Printf("Errors: %s\n", strings.Join(codes, ", "))
+	}
+}
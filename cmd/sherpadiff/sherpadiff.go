@@ -0,0 +1,76 @@
+/*
+Sherpadiff compares two versions of the documentation of a sherpa API, and lists
+added and removed sections, functions, types, fields and enum values. Breaking
+changes, such as removed functions and changed parameter types, are prefixed with
+"breaking: ".
+
+Each version is a file with sherpadoc JSON, e.g. as generated by the sherpadoc
+command, or the base URL of a sherpa API, from which the documentation is fetched.
+
+Example:
+
+	sherpadiff api-v1.json https://www.sherpadoc.org/example/
+
+The exit status is 0 if there are no breaking changes, 1 if there are, and 2 for
+errors.
+
+	Usage: sherpadiff [options] old new
+	  -breaking
+		only print breaking changes
+*/
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/mjl-/sherpa/apidiff"
+	"github.com/mjl-/sherpa/client"
+	"github.com/mjl-/sherpadoc"
+)
+
+var onlyBreaking = flag.Bool("breaking", false, "only print breaking changes")
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("sherpadiff: ")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: sherpadiff [options] old new\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	oldDoc := load(args[0])
+	newDoc := load(args[1])
+	changes := apidiff.Compare(oldDoc, newDoc)
+	for _, c := range changes {
+		if c.Breaking || !*onlyBreaking {
+			fmt.Println(c)
+		}
+	}
+	if apidiff.Breaking(changes) {
+		os.Exit(1)
+	}
+}
+
+// load reads documentation from a file, or from the sherpa API at a URL.
+func load(path string) *sherpadoc.Section {
+	doc, err := client.LoadDocs(context.Background(), path)
+	if err != nil {
+		fatalf("%s: %s", path, err)
+	}
+	return &doc.Section
+}
+
+func fatalf(format string, args ...any) {
+	log.Printf(format, args...)
+	os.Exit(2)
+}
@@ -0,0 +1,69 @@
+/*
+Sherpago generates a Go package with a typed client for a sherpa API from its
+sherpadoc documentation, and writes it to stdout. The generated client is built
+on package github.com/mjl-/sherpa/client.
+
+The source is a file with sherpadoc JSON, e.g. as generated by the sherpadoc
+command, or the base URL of a sherpa API, from which the documentation is fetched.
+
+Example:
+
+	sherpago -package example https://www.sherpadoc.org/example/ >example/example.go
+
+	Usage: sherpago [options] source
+	  -baseurl string
+		default base URL for the client, added as constant BaseURL, defaults to the URL of the source if it is a URL
+	  -package string
+		name of the generated package, defaults to the lower case API name
+	  -type string
+		name of the generated client type, defaults to the API name followed by "Client"
+*/
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/mjl-/sherpa/client"
+	"github.com/mjl-/sherpa/gogen"
+)
+
+var (
+	packageName = flag.String("package", "", "name of the generated package, defaults to the lower case API name")
+	typeName    = flag.String("type", "", `name of the generated client type, defaults to the API name followed by "Client"`)
+	baseURL     = flag.String("baseurl", "", "default base URL for the client, added as constant BaseURL, defaults to the URL of the source if it is a URL")
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("sherpago: ")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: sherpago [options] source\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	source := args[0]
+	doc, err := client.LoadDocs(context.Background(), source)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *baseURL == "" && (strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")) {
+		*baseURL = source
+	}
+
+	opts := gogen.Opts{Package: *packageName, TypeName: *typeName, BaseURL: *baseURL, Errors: doc.Errors}
+	err = gogen.Generate(os.Stdout, &doc.Section, opts)
+	if err != nil {
+		log.Fatalf("generating go code: %s", err)
+	}
+}
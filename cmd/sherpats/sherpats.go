@@ -0,0 +1,65 @@
+/*
+Sherpats generates a TypeScript client module for a sherpa API from its sherpadoc
+documentation, and writes it to stdout.
+
+The source is a file with sherpadoc JSON, e.g. as generated by the sherpadoc
+command, or the base URL of a sherpa API, from which the documentation is fetched.
+
+Example:
+
+	sherpats -class Example https://www.sherpadoc.org/example/ >example.ts
+
+	Usage: sherpats [options] source
+	  -baseurl string
+		default base URL for the client, defaults to the URL of the source if it is a URL
+	  -class string
+		name of the generated client class (default "Client")
+*/
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/mjl-/sherpa/client"
+	"github.com/mjl-/sherpa/tsgen"
+)
+
+var (
+	className = flag.String("class", "Client", "name of the generated client class")
+	baseURL   = flag.String("baseurl", "", "default base URL for the client, defaults to the URL of the source if it is a URL")
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("sherpats: ")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: sherpats [options] source\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	source := args[0]
+	doc, err := client.LoadDocs(context.Background(), source)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *baseURL == "" && (strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")) {
+		*baseURL = source
+	}
+
+	opts := tsgen.Opts{ClassName: *className, BaseURL: *baseURL, Errors: doc.Errors}
+	err = tsgen.Generate(os.Stdout, &doc.Section, opts)
+	if err != nil {
+		log.Fatalf("generating typescript: %s", err)
+	}
+}
@@ -15,5 +15,22 @@ const (
 // Errors generated by servers
 const (
 	SherpaBadRequest = "sherpa:badRequest" // Error parsing JSON request body.
-	SherpaBadParams  = "sherpa:badParams"  // Wrong number of parameters in function call.
+	SherpaBadParams  = "sherpa:badParams"  // Wrong number of parameters in function call, or invalid parameters.
+	SherpaBadResult  = "sherpa:badResult"  // Result of function call does not match its documentation, see HandlerOpts.ValidateResults.
+	SherpaBadMethod  = "sherpa:badMethod"  // Function cannot be called with GET or JSONP, see Methods. Sent with HTTP status 405.
+
+	SherpaTooLarge = "sherpa:tooLarge" // Request exceeds a limit, see HandlerOpts.Limits. Sent with HTTP status 413.
+
+	SherpaCSRF = "sherpa:csrf" // Missing or invalid CSRF token, or cross-site GET call, see HandlerOpts.CSRF. Sent with HTTP status 403.
+
+	SherpaIdempotencyInProgress = "sherpa:idempotencyInProgress" // Call with the same idempotency key is in progress, sent with HTTP status 409.
+
+	ServerError = "internalServerError" // Function failed with an *InternalServerError, or the server failed, e.g. an IdempotencyStore or encoding a stream value. Sent with HTTP status 500, or at the end of a stream.
+	ServerPanic = "server:panic"        // Function panicked, see HandlerOpts.RecoverPanics. Sent with HTTP status 500.
+)
+
+// Errors generated by servers for users, e.g. by HandlerOpts.Authorize
+const (
+	UserUnauthorized = "user:unauthorized" // Caller is not authenticated, sent with HTTP status 401.
+	UserForbidden    = "user:forbidden"    // Caller is not authorized to call the function, sent with HTTP status 403.
 )
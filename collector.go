@@ -1,7 +1,8 @@
 package sherpa
 
 // Collector facilitates collection of metrics. Functions are called by the library as such events or errors occur.
-// See https://github.com/irias/sherpa-prometheus-collector for an implementation for prometheus.
+// Package github.com/mjl-/sherpa/collector implements a Collector that serves metrics in the Prometheus text format.
+// Implement ContextCollector for details about each function call, such as request and response sizes.
 type Collector interface {
 	ProtocolError() // Invalid request at protocol-level, e.g. wrong mimetype or request body.
 	BadFunction()   // Function does not exist.
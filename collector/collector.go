@@ -0,0 +1,253 @@
+// Package collector provides a sherpa.Collector that keeps metrics in memory, and
+// serves them in the Prometheus text exposition format.
+//
+// Metrics, each with label "api" if an API name is set:
+//
+//	sherpa_function_duration_seconds (histogram, labels "function" and "code")
+//	sherpa_protocol_errors_total (counter)
+//	sherpa_bad_function_total (counter)
+//	sherpa_javascript_requests_total (counter)
+//	sherpa_json_requests_total (counter)
+//	sherpa_calls_in_flight (gauge)
+//	sherpa_responses_total (counter, labels "function", "transport" and "status")
+//	sherpa_request_size_bytes_total (counter, label "function")
+//	sherpa_response_size_bytes_total (counter, label "function")
+//
+// Label "code" is the error code of failed calls, and empty for successful calls.
+// Label "transport" is "POST", "GET" or "JSONP", label "status" the HTTP status
+// code.
+//
+// Example:
+//
+//	c := collector.New("example", nil)
+//	handler, err := sherpa.NewHandler("/example/", version, api, doc, &sherpa.HandlerOpts{Collector: c})
+//	...
+//	http.Handle("/example/", handler)
+//	http.Handle("/metrics", c)
+package collector
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mjl-/sherpa"
+)
+
+// DefaultBuckets are the upper bounds in seconds of the histogram buckets of
+// function durations, used when New is called without buckets.
+var DefaultBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Collector implements sherpa.Collector and keeps metrics in memory. It is an
+// http.Handler serving the metrics in the Prometheus text exposition format.
+type Collector struct {
+	api     string
+	buckets []float64
+
+	sync.Mutex
+	protocolErrors uint64
+	badFunction    uint64
+	javascript     uint64
+	json           uint64
+	calls          map[call]*histogram
+	inFlight       int
+	responses      map[response]uint64
+	requestSize    map[string]int64 // By function.
+	responseSize   map[string]int64 // By function.
+}
+
+var _ sherpa.ContextCollector = (*Collector)(nil)
+
+type response struct {
+	function  string
+	transport string
+	status    int
+}
+
+type call struct {
+	function string
+	code     string
+}
+
+type histogram struct {
+	counts []uint64 // Per bucket, not cumulative.
+	count  uint64
+	sum    float64
+}
+
+// New returns a new collector. If api is not empty, metrics are labeled with it,
+// for distinguishing multiple APIs served by a single program. Buckets are the
+// upper bounds of the function duration histograms, in seconds, in increasing
+// order. If nil, DefaultBuckets are used.
+func New(api string, buckets []float64) *Collector {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	return &Collector{
+		api:          api,
+		buckets:      buckets,
+		calls:        map[call]*histogram{},
+		responses:    map[response]uint64{},
+		requestSize:  map[string]int64{},
+		responseSize: map[string]int64{},
+	}
+}
+
+// ProtocolError implements sherpa.Collector.
+func (c *Collector) ProtocolError() {
+	c.Lock()
+	defer c.Unlock()
+	c.protocolErrors++
+}
+
+// BadFunction implements sherpa.Collector.
+func (c *Collector) BadFunction() {
+	c.Lock()
+	defer c.Unlock()
+	c.badFunction++
+}
+
+// JavaScript implements sherpa.Collector.
+func (c *Collector) JavaScript() {
+	c.Lock()
+	defer c.Unlock()
+	c.javascript++
+}
+
+// JSON implements sherpa.Collector.
+func (c *Collector) JSON() {
+	c.Lock()
+	defer c.Unlock()
+	c.json++
+}
+
+// FunctionCall implements sherpa.Collector.
+func (c *Collector) FunctionCall(name string, durationSec float64, errorCode string) {
+	c.Lock()
+	defer c.Unlock()
+	k := call{name, errorCode}
+	h := c.calls[k]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(c.buckets))}
+		c.calls[k] = h
+	}
+	if i, _ := slices.BinarySearch(c.buckets, durationSec); i < len(c.buckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += durationSec
+}
+
+// CallStart implements sherpa.ContextCollector.
+func (c *Collector) CallStart(m sherpa.CallMetrics) {
+	c.Lock()
+	defer c.Unlock()
+	// Not m.InFlight: calls can take the lock in another order than they updated
+	// the count in the handler.
+	c.inFlight++
+}
+
+// CallDone implements sherpa.ContextCollector.
+func (c *Collector) CallDone(m sherpa.CallMetrics) {
+	c.Lock()
+	defer c.Unlock()
+	c.inFlight--
+	c.responses[response{m.Function, m.Transport, m.Status}]++
+	c.requestSize[m.Function] += m.RequestSize
+	c.responseSize[m.Function] += m.ResponseSize
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "405 - method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := c.WriteMetrics(w); err != nil {
+		log.Println("writing metrics:", err)
+	}
+}
+
+// WriteMetrics writes the metrics in the Prometheus text exposition format to w.
+func (c *Collector) WriteMetrics(w io.Writer) error {
+	c.Lock()
+	defer c.Unlock()
+
+	var b strings.Builder
+	counter := func(name, help string, v uint64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n%s%s %d\n", name, help, name, name, c.labels(), v)
+	}
+	counter("sherpa_protocol_errors_total", "Requests with protocol errors, e.g. a bad content-type or request body.", c.protocolErrors)
+	counter("sherpa_bad_function_total", "Calls to functions that do not exist.", c.badFunction)
+	counter("sherpa_javascript_requests_total", "Requests for sherpa.js.", c.javascript)
+	counter("sherpa_json_requests_total", "Requests for sherpa.json.", c.json)
+
+	fmt.Fprintf(&b, "# HELP sherpa_calls_in_flight Function calls in progress.\n# TYPE sherpa_calls_in_flight gauge\nsherpa_calls_in_flight%s %d\n", c.labels(), c.inFlight)
+
+	responses := slices.SortedFunc(maps.Keys(c.responses), func(a, b response) int {
+		return cmp.Or(strings.Compare(a.function, b.function), strings.Compare(a.transport, b.transport), cmp.Compare(a.status, b.status))
+	})
+	fmt.Fprintf(&b, "# HELP sherpa_responses_total Responses for function calls, by function, transport and HTTP status.\n# TYPE sherpa_responses_total counter\n")
+	for _, k := range responses {
+		fmt.Fprintf(&b, "sherpa_responses_total%s %d\n", c.labels("function", k.function, "transport", k.transport, "status", strconv.Itoa(k.status)), c.responses[k])
+	}
+	sizes := func(name, help string, m map[string]int64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, fn := range slices.Sorted(maps.Keys(m)) {
+			fmt.Fprintf(&b, "%s%s %d\n", name, c.labels("function", fn), m[fn])
+		}
+	}
+	sizes("sherpa_request_size_bytes_total", "Size of request bodies (or query strings) of function calls, by function.", c.requestSize)
+	sizes("sherpa_response_size_bytes_total", "Size of response bodies of function calls, by function.", c.responseSize)
+
+	const name = "sherpa_function_duration_seconds"
+	fmt.Fprintf(&b, "# HELP %s Duration of function calls, by function and error code (empty on success).\n# TYPE %s histogram\n", name, name)
+	keys := slices.SortedFunc(maps.Keys(c.calls), func(a, b call) int {
+		return cmp.Or(strings.Compare(a.function, b.function), strings.Compare(a.code, b.code))
+	})
+	for _, k := range keys {
+		h := c.calls[k]
+		labels := []string{"function", k.function, "code", k.code}
+		var cumulative uint64
+		for i, le := range c.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", name, c.labels(append(labels, "le", formatFloat(le))...), cumulative)
+		}
+		fmt.Fprintf(&b, "%s_bucket%s %d\n", name, c.labels(append(labels, "le", "+Inf")...), h.count)
+		fmt.Fprintf(&b, "%s_sum%s %s\n", name, c.labels(labels...), formatFloat(h.sum))
+		fmt.Fprintf(&b, "%s_count%s %d\n", name, c.labels(labels...), h.count)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// labels returns the label set for pairs of names and values, including the api
+// label if set. An empty string is returned if there are no labels.
+func (c *Collector) labels(pairs ...string) string {
+	if c.api != "" {
+		pairs = append([]string{"api", c.api}, pairs...)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	var l []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		l = append(l, pairs[i]+`="`+labelEscaper.Replace(pairs[i+1])+`"`)
+	}
+	return "{" + strings.Join(l, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
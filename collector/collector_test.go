@@ -0,0 +1,46 @@
+package collector
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mjl-/sherpa"
+)
+
+func TestCollector(t *testing.T) {
+	c := New("example", []float64{0.1, 1})
+	c.FunctionCall("sum", 0.05, "")
+	c.FunctionCall("sum", 0.5, "")
+	c.FunctionCall("sum", 2, "")
+	c.FunctionCall("fail", 0.1, `user:"x"`)
+	c.BadFunction()
+	c.JSON()
+	c.JSON()
+
+	// Two calls start, the first call ends. Snapshots of the in-flight count can
+	// arrive out of order, the gauge must not depend on them.
+	c.CallStart(sherpa.CallMetrics{Function: "sum", InFlight: 2})
+	c.CallStart(sherpa.CallMetrics{Function: "sum", InFlight: 1})
+	c.CallDone(sherpa.CallMetrics{Function: "sum", Transport: "POST", Status: 200, InFlight: 1})
+
+	resp := httptest.NewRecorder()
+	c.ServeHTTP(resp, httptest.NewRequest("GET", "/metrics", nil))
+	s := resp.Body.String()
+	for _, exp := range []string{
+		`sherpa_bad_function_total{api="example"} 1` + "\n",
+		`sherpa_calls_in_flight{api="example"} 1` + "\n",
+		`sherpa_json_requests_total{api="example"} 2` + "\n",
+		`sherpa_protocol_errors_total{api="example"} 0` + "\n",
+		`sherpa_function_duration_seconds_bucket{api="example",function="sum",code="",le="0.1"} 1` + "\n",
+		`sherpa_function_duration_seconds_bucket{api="example",function="sum",code="",le="1"} 2` + "\n",
+		`sherpa_function_duration_seconds_bucket{api="example",function="sum",code="",le="+Inf"} 3` + "\n",
+		`sherpa_function_duration_seconds_sum{api="example",function="sum",code=""} 2.55` + "\n",
+		`sherpa_function_duration_seconds_count{api="example",function="sum",code=""} 3` + "\n",
+		`sherpa_function_duration_seconds_bucket{api="example",function="fail",code="user:\"x\"",le="0.1"} 1` + "\n",
+	} {
+		if !strings.Contains(s, exp) {
+			t.Fatalf("missing %q in metrics:\n%s", exp, s)
+		}
+	}
+}
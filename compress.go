@@ -0,0 +1,150 @@
+package sherpa
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultCompressMinSize is the default for HandlerOpts.CompressMinSize.
+const defaultCompressMinSize = 1024
+
+// acceptEncoding returns the content encoding to use for a response to a
+// request with Accept-Encoding header value s: "gzip", "deflate" or the empty
+// string for no compression. Gzip is preferred over deflate if both are
+// accepted with the same quality. A "*" applies to encodings not explicitly
+// listed, so "gzip;q=0, *" selects deflate.
+func acceptEncoding(s string) string {
+	qualities := map[string]float64{}
+	for _, e := range strings.Split(s, ",") {
+		name, params, _ := strings.Cut(e, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+			if k == "q" {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		qualities[name] = q
+	}
+	var best string
+	var bestQ float64
+	for _, name := range []string{"gzip", "deflate"} {
+		q, ok := qualities[name]
+		if !ok {
+			q = qualities["*"]
+		}
+		if q > bestQ {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// compressWriter compresses a response with the encoding accepted by the
+// client, if the response is large enough. The response is buffered until it is
+// at least minSize bytes, or until it is flushed or closed. Streams, responses
+// with a Content-Encoding and responses without body are not compressed.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string // "gzip" or "deflate".
+	minSize  int
+	status   int    // Status passed to WriteHeader, 0 if not yet called.
+	buf      []byte // Response data before deciding whether to compress.
+	started  bool   // Whether WriteHeader was called on ResponseWriter.
+	w        io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(buf []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if cw.started {
+		if cw.w != nil {
+			return cw.w.Write(buf)
+		}
+		return cw.ResponseWriter.Write(buf)
+	}
+	cw.buf = append(cw.buf, buf...)
+	if len(cw.buf) >= cw.minSize {
+		if err := cw.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(buf), nil
+}
+
+// start writes the header, with a Content-Encoding if compress is set and the
+// response can be compressed, and the buffered data.
+func (cw *compressWriter) start(compress bool) error {
+	cw.started = true
+	h := cw.Header()
+	ct := h.Get("Content-Type")
+	if compress && h.Get("Content-Encoding") == "" && cw.status != http.StatusNoContent && cw.status != http.StatusNotModified && !strings.HasPrefix(ct, "text/event-stream") && !strings.HasPrefix(ct, "application/x-ndjson") {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		if cw.encoding == "gzip" {
+			cw.w = gzip.NewWriter(cw.ResponseWriter)
+		} else {
+			cw.w = zlib.NewWriter(cw.ResponseWriter)
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.w != nil {
+		_, err = cw.w.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Flush writes out buffered data, without compression if the response was not
+// started yet, as is the case for streams.
+func (cw *compressWriter) Flush() {
+	if !cw.started && cw.status != 0 {
+		if err := cw.start(false); err != nil {
+			return
+		}
+	}
+	if f, ok := cw.w.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			return
+		}
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// close finishes the response.
+func (cw *compressWriter) close() error {
+	if !cw.started && cw.status != 0 {
+		if err := cw.start(false); err != nil {
+			return err
+		}
+	}
+	if cw.w != nil {
+		return cw.w.Close()
+	}
+	return nil
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
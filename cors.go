@@ -0,0 +1,107 @@
+package sherpa
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS is a policy for cross-origin resource sharing, see HandlerOpts.CORS.
+//
+// CORS headers are only sent for requests with an Origin header that is allowed
+// by the policy. The allowed origin is sent back in the
+// Access-Control-Allow-Origin header, with a "Vary: Origin" header, unless
+// AllowOrigins contains "*".
+type CORS struct {
+	// Origins allowed to make requests, e.g. "https://app.example.com". An origin
+	// of "*" allows all origins.
+	AllowOrigins []string
+
+	// If set, called for origins not in AllowOrigins, e.g. to allow all subdomains
+	// of a domain.
+	AllowOrigin func(origin string) bool
+
+	// Whether browsers can make requests with credentials, e.g. cookies, by
+	// sending an "Access-Control-Allow-Credentials: true" header. Cannot be combined
+	// with origin "*" in AllowOrigins, NewHandler returns an error.
+	AllowCredentials bool
+
+	// Request headers browsers may send, in addition to Content-Type,
+	// Idempotency-Key (with HandlerOpts.IdempotencyStore) and the CSRF header (with
+	// HandlerOpts.CSRF), e.g. "Authorization" or "traceparent".
+	AllowHeaders []string
+
+	// Response headers browsers let scripts read, in addition to the
+	// CORS-safelisted headers, e.g. "Idempotent-Replayed".
+	ExposeHeaders []string
+
+	// How long browsers can cache the response to a preflight request. Sent in the
+	// Access-Control-Max-Age header if non-zero.
+	MaxAge time.Duration
+}
+
+// check returns an error for an invalid policy.
+func (c *CORS) check() error {
+	if c.AllowCredentials && slices.Contains(c.AllowOrigins, "*") {
+		return fmt.Errorf(`cors: origin "*" cannot be combined with AllowCredentials`)
+	}
+	return nil
+}
+
+// allowed returns whether requests from origin are allowed.
+func (c *CORS) allowed(origin string) bool {
+	return slices.Contains(c.AllowOrigins, origin) || slices.Contains(c.AllowOrigins, "*") || c.AllowOrigin != nil && c.AllowOrigin(origin)
+}
+
+// setCORSHeaders sets the CORS headers for a response to r, according to
+// HandlerOpts.NoCORS and HandlerOpts.CORS.
+func (h *handler) setCORSHeaders(hdr http.Header, r *http.Request) {
+	if h.opts.NoCORS {
+		return
+	}
+	allowHeaders := "Content-Type"
+	if h.opts.IdempotencyStore != nil {
+		allowHeaders += ", Idempotency-Key"
+	}
+	if h.opts.CSRF != nil {
+		allowHeaders += ", " + h.opts.CSRF.header()
+	}
+
+	c := h.opts.CORS
+	if c == nil {
+		hdr.Set("Access-Control-Allow-Origin", "*")
+		hdr.Set("Access-Control-Allow-Methods", "GET, POST")
+		hdr.Set("Access-Control-Allow-Headers", allowHeaders)
+		return
+	}
+
+	origin := r.Header.Get("Origin")
+	hdr.Add("Vary", "Origin")
+	if origin == "" || !c.allowed(origin) {
+		return
+	}
+	if slices.Contains(c.AllowOrigins, "*") {
+		hdr.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		hdr.Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.AllowCredentials {
+		hdr.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(c.ExposeHeaders) > 0 {
+		hdr.Set("Access-Control-Expose-Headers", strings.Join(c.ExposeHeaders, ", "))
+	}
+	if r.Method == "OPTIONS" {
+		hdr.Set("Access-Control-Allow-Methods", "GET, POST")
+		if len(c.AllowHeaders) > 0 {
+			allowHeaders += ", " + strings.Join(c.AllowHeaders, ", ")
+		}
+		hdr.Set("Access-Control-Allow-Headers", allowHeaders)
+		if c.MaxAge > 0 {
+			hdr.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge/time.Second)))
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package sherpa
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"slices"
+)
+
+// CSRF configures protection against cross-site request forgery, see
+// HandlerOpts.CSRF. Useful for APIs that authenticate browsers with cookies.
+//
+// Function calls with POST must have the CSRF header. Browsers only let other
+// web sites add custom headers to requests after a CORS preflight, see
+// HandlerOpts.CORS. If Cookie is set, the header must have the same value as the
+// cookie (the "double-submit" pattern). sherpa.js adds the header automatically.
+//
+// Function calls with GET (including JSONP) are rejected if the browser
+// indicates they are cross-site: through a Sec-Fetch-Site header other than
+// "same-origin" or "none", or through an Origin header that is not the origin of
+// the API or one of TrustedOrigins. The origin of the API is taken from the
+// request: its host and TLS connection, or the X-Forwarded-Host and
+// X-Forwarded-Proto headers set by a reverse proxy. Browsers load JSONP scripts
+// without an Origin header, so cross-site JSONP calls are only rejected by
+// browsers that send Sec-Fetch-Site. GET requests with neither header, e.g. from
+// older browsers or non-browser clients, are allowed.
+//
+// Rejected calls get an error with code SherpaCSRF and HTTP status 403. The
+// "_docs" function, which has no side effects, is not checked.
+type CSRF struct {
+	// Name of the request header with the CSRF token. Defaults to
+	// "X-Sherpa-CSRF".
+	Header string
+
+	// If set, the name of the cookie with the CSRF token, which the header must
+	// match. If the cookie is not present in a request for sherpa.js or
+	// sherpa.json, the handler sets it to a random token, for the path of the API.
+	// The cookie cannot be HttpOnly: clients in the browser read it. Only pages with
+	// the origin of the API can read the cookie, so browsers on other origins,
+	// including other subdomains, cannot call the API. If not set, the header can
+	// have any non-empty value.
+	Cookie string
+
+	// Origins, e.g. "https://app.example.com", allowed to make GET calls in
+	// addition to the origin of the API. Calls with POST from other origins must
+	// be allowed through HandlerOpts.CORS.
+	TrustedOrigins []string
+}
+
+// JSONCSRF describes the CSRF token that function calls must send, published in
+// sherpa.json, see HandlerOpts.CSRF.
+type JSONCSRF struct {
+	Header string `json:"header"`           // Name of request header with the token.
+	Cookie string `json:"cookie,omitempty"` // Name of the cookie with the token, if any.
+}
+
+func (c *CSRF) header() string {
+	if c.Header == "" {
+		return "X-Sherpa-CSRF"
+	}
+	return c.Header
+}
+
+// checkCSRF returns whether request r calling function name passes the CSRF
+// checks of HandlerOpts.CSRF. Calls are always allowed if CSRF is not set, and
+// "_docs" can always be called: it has no side effects, and is called by the
+// documentation viewer at docs/, which does not send a CSRF token.
+func (h *handler) checkCSRF(r *http.Request, name string) bool {
+	c := h.opts.CSRF
+	if c == nil || name == "_docs" {
+		return true
+	}
+	if r.Method == "GET" {
+		if site := r.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" && site != "none" {
+			return false
+		}
+		origin := r.Header.Get("Origin")
+		return origin == "" || origin == requestOrigin(r) || slices.Contains(c.TrustedOrigins, origin)
+	}
+	token := r.Header.Get(c.header())
+	if token == "" {
+		return false
+	}
+	if c.Cookie == "" {
+		return true
+	}
+	cookie, err := r.Cookie(c.Cookie)
+	return err == nil && subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(token)) == 1
+}
+
+// requestOrigin returns the origin of the API as seen by the browser that sent r,
+// e.g. "https://api.example".
+func requestOrigin(r *http.Request) string {
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		host = r.Host
+	}
+	scheme := "http"
+	if isHTTPS(r) {
+		scheme = "https"
+	}
+	return scheme + "://" + host
+}
+
+// isHTTPS returns whether r was made over TLS, directly or through a reverse
+// proxy.
+func isHTTPS(r *http.Request) bool {
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		return proto == "https"
+	}
+	return r.TLS != nil
+}
+
+// setCSRFCookie sets a cookie with a new random CSRF token if HandlerOpts.CSRF
+// has a cookie and r does not have it yet. Called for sherpa.js and sherpa.json,
+// which clients load before calling functions.
+func (h *handler) setCSRFCookie(w http.ResponseWriter, r *http.Request) {
+	c := h.opts.CSRF
+	if c == nil || c.Cookie == "" {
+		return
+	}
+	if _, err := r.Cookie(c.Cookie); err == nil {
+		return
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     c.Cookie,
+		Value:    hex.EncodeToString(buf),
+		Path:     h.path,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteStrictMode,
+	})
+}
@@ -0,0 +1,11 @@
+package sherpa
+
+import (
+	_ "embed"
+)
+
+// docsHTML is a self-contained page that fetches the documentation from the
+// "_docs" function and renders it. Served at "docs/".
+//
+//go:embed docs.html
+var docsHTML []byte
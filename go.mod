@@ -1,5 +1,5 @@
 module github.com/mjl-/sherpa
 
-go 1.21
+go 1.23
 
 require github.com/mjl-/sherpadoc v0.0.0-20190505200843-c0a7f43f5f1d
@@ -0,0 +1,405 @@
+// Package gogen generates a Go package with a typed client for a sherpa API from
+// its sherpadoc documentation.
+//
+// The package has a struct type for each Struct, a named type with constants for
+// each Ints and Strings, and a client type with a method for each function. The
+// client type is built on the client package. Function "sum" with parameters "a"
+// and "b" of type int becomes:
+//
+//	func (c *ExampleClient) Sum(ctx context.Context, a int, b int) (int, error)
+//
+// Typewords are mapped to Go types: int64s and uint64s to int64 and uint64 (with
+// the "string" option in struct tags for fields), timestamp to time.Time, nullable
+// to a pointer, arrays to slices and objects to maps with string keys.
+package gogen
+
+import (
+	"fmt"
+	"go/format"
+	"go/token"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/mjl-/sherpadoc"
+)
+
+// Opts are options for Generate.
+type Opts struct {
+	// Name of the generated package. Defaults to the lower case API name.
+	Package string
+
+	// Name of the generated client type. Defaults to the API name followed by
+	// "Client", e.g. "ExampleClient".
+	TypeName string
+
+	// Default base URL for the client, e.g. https://www.sherpadoc.org/example/,
+	// added as constant BaseURL. Optional.
+	BaseURL string
+
+	// Error codes declared for functions, keyed by function name, as returned in
+	// sherpa.json and by the "_docs" function. Added to the documentation comment
+	// of the methods.
+	Errors map[string][]string
+}
+
+// Generate writes the source code of a Go package for the API documented by doc
+// to w.
+//
+// An error is returned for references to undefined types.
+func Generate(w io.Writer, doc *sherpadoc.Section, opts Opts) error {
+	if opts.Package == "" {
+		opts.Package = packageName(doc.Name)
+	}
+	if opts.TypeName == "" {
+		opts.TypeName = exported(doc.Name) + "Client"
+	}
+	g := &generator{opts: opts, types: map[string]bool{}, imports: map[string]bool{}}
+	g.gatherTypes(doc)
+
+	// Types and methods are written first, so we know which imports are needed.
+	if err := g.typesSection(doc); err != nil {
+		return err
+	}
+	if err := g.functions(doc); err != nil {
+		return err
+	}
+	body := g.b.String()
+	g.b.Reset()
+
+	g.printf("// Code generated by sherpago from sherpadoc documentation for %s, version %s. DO NOT EDIT.\n\n", doc.Name, doc.Version)
+	g.printf("// Package %s is a client for the %s API.\n", opts.Package, doc.Name)
+	g.printf("package %s\n\n", opts.Package)
+	g.imports["context"] = true
+	g.imports["github.com/mjl-/sherpa/client"] = true
+	var std, other []string
+	for imp := range g.imports {
+		if strings.Contains(strings.Split(imp, "/")[0], ".") {
+			other = append(other, imp)
+		} else {
+			std = append(std, imp)
+		}
+	}
+	sort.Strings(std)
+	sort.Strings(other)
+	g.printf("import (\n")
+	for _, imp := range std {
+		g.printf("\t%q\n", imp)
+	}
+	g.printf("\n")
+	for _, imp := range other {
+		g.printf("\t%q\n", imp)
+	}
+	g.printf(")\n\n")
+
+	if opts.BaseURL != "" {
+		g.printf("// BaseURL is the default base URL of the API.\nconst BaseURL = %q\n\n", opts.BaseURL)
+	}
+	g.comment("", fmt.Sprintf("%s calls the functions of the %s API.\n\n%s", opts.TypeName, doc.Name, doc.Docs))
+	g.printf("type %s struct {\n\tClient *client.Client\n}\n\n", opts.TypeName)
+	g.printf("// New%s returns a client for the API at baseURL, e.g. https://www.sherpadoc.org/example/.\n", opts.TypeName)
+	g.printf("func New%s(baseURL string) *%s {\n", opts.TypeName, opts.TypeName)
+	g.printf("\treturn &%s{&client.Client{BaseURL: baseURL, Functions: []string{}}}\n}\n", opts.TypeName)
+	g.b.WriteString(body)
+
+	buf, err := format.Source([]byte(g.b.String()))
+	if err != nil {
+		return fmt.Errorf("formatting generated code: %v", err)
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+type generator struct {
+	opts    Opts
+	types   map[string]bool
+	imports map[string]bool
+	b       strings.Builder
+}
+
+func (g *generator) printf(format string, args ...any) {
+	fmt.Fprintf(&g.b, format, args...)
+}
+
+// comment writes text as a comment, with each line indented.
+func (g *generator) comment(indent, text string) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return
+	}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, " \t")
+		if line == "" {
+			g.printf("%s//\n", indent)
+		} else {
+			g.printf("%s// %s\n", indent, line)
+		}
+	}
+}
+
+func (g *generator) gatherTypes(sec *sherpadoc.Section) {
+	for _, t := range sec.Structs {
+		g.types[t.Name] = true
+	}
+	for _, t := range sec.Ints {
+		g.types[t.Name] = true
+	}
+	for _, t := range sec.Strings {
+		g.types[t.Name] = true
+	}
+	for _, subsec := range sec.Sections {
+		g.gatherTypes(subsec)
+	}
+}
+
+func (g *generator) typesSection(sec *sherpadoc.Section) error {
+	for _, t := range sec.Structs {
+		g.printf("\n")
+		g.comment("", t.Docs)
+		g.printf("type %s struct {\n", t.Name)
+		for _, f := range t.Fields {
+			gt, quoted, err := g.goType(f.Typewords, true)
+			if err != nil {
+				return fmt.Errorf("struct %s, field %s: %v", t.Name, f.Name, err)
+			}
+			name := exported(f.Name)
+			var tag string
+			if name != f.Name {
+				tag = f.Name
+			}
+			if quoted {
+				tag += ",string"
+			}
+			g.comment("\t", f.Docs)
+			if tag != "" {
+				g.printf("\t%s %s `json:%q`\n", name, gt, tag)
+			} else {
+				g.printf("\t%s %s\n", name, gt)
+			}
+		}
+		g.printf("}\n")
+	}
+	for _, t := range sec.Ints {
+		g.printf("\n")
+		g.comment("", t.Docs)
+		g.printf("type %s int\n\nconst (\n", t.Name)
+		for _, v := range t.Values {
+			g.comment("\t", v.Docs)
+			g.printf("\t%s %s = %d\n", v.Name, t.Name, v.Value)
+		}
+		g.printf(")\n")
+	}
+	for _, t := range sec.Strings {
+		g.printf("\n")
+		g.comment("", t.Docs)
+		g.printf("type %s string\n\nconst (\n", t.Name)
+		for _, v := range t.Values {
+			g.comment("\t", v.Docs)
+			g.printf("\t%s %s = %q\n", v.Name, t.Name, v.Value)
+		}
+		g.printf(")\n")
+	}
+	for _, subsec := range sec.Sections {
+		if err := g.typesSection(subsec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Names used in the generated methods, parameters are renamed to not clash.
+var locals = map[string]bool{"c": true, "ctx": true, "err": true, "sherpa": true, "strconv": true}
+
+func (g *generator) functions(sec *sherpadoc.Section) error {
+	for _, fn := range sec.Functions {
+		params := []string{"ctx context.Context"}
+		args := []string{fmt.Sprintf("%q", fn.Name)}
+		for i, arg := range fn.Params {
+			name := identifier(arg.Name, "p", i)
+			if locals[name] || strings.HasPrefix(name, "r") && strings.Trim(name[1:], "0123456789") == "" {
+				name += "_"
+			}
+			gt, err := g.paramType(arg.Typewords)
+			if err != nil {
+				return fmt.Errorf("function %s, param %s: %v", fn.Name, arg.Name, err)
+			}
+			params = append(params, name+" "+gt)
+			if gt == "int64" && arg.Typewords[0] == "int64s" {
+				g.imports["strconv"] = true
+				name = "strconv.FormatInt(" + name + ", 10)"
+			} else if gt == "uint64" && arg.Typewords[0] == "uint64s" {
+				g.imports["strconv"] = true
+				name = "strconv.FormatUint(" + name + ", 10)"
+			}
+			args = append(args, name)
+		}
+
+		var returns, vars, results []string
+		for i, arg := range fn.Returns {
+			gt, err := g.paramType(arg.Typewords)
+			if err != nil {
+				return fmt.Errorf("function %s, return %s: %v", fn.Name, arg.Name, err)
+			}
+			returns = append(returns, gt)
+			v := fmt.Sprintf("r%d", i)
+			result := v
+			// Int64s and Uint64s are parsed from JSON strings, and converted.
+			if gt == "int64" && arg.Typewords[0] == "int64s" {
+				g.imports["github.com/mjl-/sherpa"] = true
+				gt = "sherpa.Int64s"
+				result = "int64(" + v + ")"
+			} else if gt == "uint64" && arg.Typewords[0] == "uint64s" {
+				g.imports["github.com/mjl-/sherpa"] = true
+				gt = "sherpa.Uint64s"
+				result = "uint64(" + v + ")"
+			}
+			vars = append(vars, v+" "+gt)
+			results = append(results, result)
+		}
+		returns = append(returns, "error")
+
+		docs := fn.Docs
+		if codes := g.opts.Errors[fn.Name]; len(codes) > 0 {
+			docs = strings.TrimSpace(docs) + "\n\nErrors returned with code: " + strings.Join(codes, ", ") + "."
+		}
+		g.printf("\n")
+		g.comment("", docs)
+		g.printf("func (c *%s) %s(%s) (%s) {\n", g.opts.TypeName, exported(fn.Name), strings.Join(params, ", "), strings.Join(returns, ", "))
+		switch len(vars) {
+		case 0:
+			g.printf("\treturn c.Client.Call(ctx, nil, %s)\n", strings.Join(args, ", "))
+		case 1:
+			g.printf("\tvar %s\n", vars[0])
+			g.printf("\terr := c.Client.Call(ctx, &r0, %s)\n", strings.Join(args, ", "))
+			g.printf("\treturn %s, err\n", results[0])
+		default:
+			// Multiple return values are returned as a JSON array.
+			var ptrs []string
+			for i, v := range vars {
+				g.printf("\tvar %s\n", v)
+				ptrs = append(ptrs, fmt.Sprintf("&r%d", i))
+			}
+			g.printf("\terr := c.Client.Call(ctx, &[]any{%s}, %s)\n", strings.Join(ptrs, ", "), strings.Join(args, ", "))
+			g.printf("\treturn %s, err\n", strings.Join(results, ", "))
+		}
+		g.printf("}\n")
+	}
+	for _, subsec := range sec.Sections {
+		if err := g.functions(subsec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// paramType returns the Go type for a parameter or return value. Top-level
+// int64s and uint64s are returned as int64 and uint64, and must be converted by
+// the caller.
+func (g *generator) paramType(typewords []string) (string, error) {
+	if len(typewords) == 1 && typewords[0] == "int64s" {
+		return "int64", nil
+	} else if len(typewords) == 1 && typewords[0] == "uint64s" {
+		return "uint64", nil
+	}
+	gt, _, err := g.goType(typewords, false)
+	return gt, err
+}
+
+// goType returns the Go type for typewords. For struct fields (field is set),
+// quoted is returned for int64s and uint64s that must be marshaled with the
+// "string" option.
+func (g *generator) goType(typewords []string, field bool) (gt string, quoted bool, err error) {
+	if len(typewords) == 0 {
+		return "", false, fmt.Errorf("missing type")
+	}
+	t, rest := typewords[0], typewords[1:]
+	switch t {
+	case "nullable":
+		gt, quoted, err := g.goType(rest, field)
+		if err != nil {
+			return "", false, err
+		}
+		// Slices, maps and interfaces can already be nil.
+		if strings.HasPrefix(gt, "[]") || strings.HasPrefix(gt, "map[") || gt == "any" {
+			return gt, quoted, nil
+		}
+		return "*" + gt, quoted, nil
+	case "[]", "{}":
+		et, _, err := g.goType(rest, false)
+		if err != nil {
+			return "", false, err
+		}
+		if t == "[]" {
+			return "[]" + et, false, nil
+		}
+		return "map[string]" + et, false, nil
+	}
+	if len(rest) > 0 {
+		return "", false, fmt.Errorf("unexpected words after %q: %v", t, rest)
+	}
+	switch t {
+	case "any":
+		return "any", false, nil
+	case "bool", "int8", "uint8", "int16", "uint16", "int32", "uint32", "int64", "uint64", "float32", "float64", "string":
+		return t, false, nil
+	case "int64s", "uint64s":
+		if field {
+			return t[:len(t)-1], true, nil
+		}
+		g.imports["github.com/mjl-/sherpa"] = true
+		return "sherpa." + strings.ToUpper(t[:1]) + t[1:], false, nil
+	case "timestamp":
+		g.imports["time"] = true
+		return "time.Time", false, nil
+	}
+	if !g.types[t] {
+		return "", false, fmt.Errorf("undefined type %q", t)
+	}
+	return t, false, nil
+}
+
+// exported returns name with the first letter in upper case, and characters not
+// valid in Go identifiers removed.
+func exported(name string) string {
+	var b strings.Builder
+	for _, c := range name {
+		if unicode.IsLetter(c) || c == '_' || b.Len() > 0 && unicode.IsDigit(c) {
+			if b.Len() == 0 {
+				c = unicode.ToUpper(c)
+			}
+			b.WriteRune(c)
+		}
+	}
+	if b.Len() == 0 {
+		return "X"
+	}
+	return b.String()
+}
+
+// identifier returns a valid Go identifier for name, using prefix and index for
+// empty names.
+func identifier(name, prefix string, index int) string {
+	if name == "" || !token.IsIdentifier(name) {
+		return prefix + strconv.Itoa(index)
+	}
+	if token.IsKeyword(name) {
+		return name + "_"
+	}
+	return name
+}
+
+// packageName returns a package name for an API name, "api" if it has no letters.
+func packageName(name string) string {
+	var b strings.Builder
+	for _, c := range strings.ToLower(name) {
+		if c >= 'a' && c <= 'z' || b.Len() > 0 && c >= '0' && c <= '9' {
+			b.WriteRune(c)
+		}
+	}
+	if b.Len() == 0 {
+		return "api"
+	}
+	return b.String()
+}
@@ -0,0 +1,63 @@
+package gogen
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mjl-/sherpadoc"
+)
+
+func TestGenerate(t *testing.T) {
+	doc := &sherpadoc.Section{
+		Name:    "Example",
+		Version: "1.0.0",
+		Functions: []*sherpadoc.Function{
+			{
+				Name:    "sum",
+				Params:  []sherpadoc.Arg{{Name: "a", Typewords: []string{"int32"}}, {Name: "b", Typewords: []string{"int32"}}},
+				Returns: []sherpadoc.Arg{{Name: "r", Typewords: []string{"int32"}}},
+			},
+			{
+				Name:    "get",
+				Params:  []sherpadoc.Arg{{Name: "id", Typewords: []string{"int64s"}}},
+				Returns: []sherpadoc.Arg{{Typewords: []string{"nullable", "Item"}}, {Typewords: []string{"int64s"}}},
+			},
+		},
+		Structs: []sherpadoc.Struct{
+			{
+				Name: "Item",
+				Fields: []sherpadoc.Field{
+					{Name: "ID", Typewords: []string{"int64s"}},
+					{Name: "tags", Typewords: []string{"[]", "int64s"}},
+					{Name: "Created", Typewords: []string{"nullable", "timestamp"}},
+				},
+			},
+		},
+	}
+
+	var b strings.Builder
+	err := Generate(&b, doc, Opts{Errors: map[string][]string{"get": {"user:notFound"}}})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	s := b.String()
+	for _, exp := range []string{
+		"package example\n",
+		"\tID      int64           `json:\",string\"`\n",
+		"\tTags    []sherpa.Int64s `json:\"tags\"`\n",
+		"\tCreated *time.Time\n",
+		"func (c *ExampleClient) Sum(ctx context.Context, a int32, b int32) (int32, error) {",
+		"func (c *ExampleClient) Get(ctx context.Context, id int64) (*Item, int64, error) {",
+		`err := c.Client.Call(ctx, &[]any{&r0, &r1}, "get", strconv.FormatInt(id, 10))`,
+		"// Errors returned with code: user:notFound.",
+	} {
+		if !strings.Contains(s, exp) {
+			t.Fatalf("missing %q in output:\n%s", exp, s)
+		}
+	}
+
+	doc.Functions[0].Returns[0].Typewords = []string{"Bogus"}
+	if err := Generate(&b, doc, Opts{}); err == nil {
+		t.Fatalf("generate with undefined type succeeded")
+	}
+}
@@ -2,8 +2,12 @@ package sherpa
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -12,10 +16,14 @@ import (
 	"mime"
 	"net/http"
 	"reflect"
+	"runtime/debug"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
 	"unicode"
 
+	"github.com/mjl-/sherpa/openapi"
 	"github.com/mjl-/sherpadoc"
 )
 
@@ -31,6 +39,24 @@ type JSON struct {
 	Version          string   `json:"version"`
 	SherpaVersion    int      `json:"sherpaVersion"`
 	SherpadocVersion int      `json:"sherpadocVersion"`
+
+	// Error codes that functions can return, keyed by function name. Only for
+	// functions with declared errors, see FunctionOpts.Errors.
+	Errors map[string][]string `json:"errors,omitempty"`
+
+	// Names of functions that are idempotent, see FunctionOpts.Idempotent.
+	Idempotent []string `json:"idempotent,omitempty"`
+
+	// Whether POST calls with an Idempotency-Key header are executed only once,
+	// see HandlerOpts.IdempotencyStore.
+	IdempotencyKeys bool `json:"idempotencyKeys,omitempty"`
+
+	// HTTP methods each function can be called with, keyed by function name. See
+	// Methods.
+	Methods map[string]Methods `json:"methods,omitempty"`
+
+	// CSRF token that function calls must send, see HandlerOpts.CSRF.
+	CSRF *JSONCSRF `json:"csrf,omitempty"`
 }
 
 // HandlerOpts are options for creating a new handler.
@@ -52,6 +78,28 @@ type HandlerOpts struct {
 	// method".
 	NoCORS bool
 
+	// Policy for cross-origin requests. If nil, and NoCORS is not set, all origins
+	// are allowed, without credentials: responses have an
+	// "Access-Control-Allow-Origin: *" header. Ignored if NoCORS is set.
+	CORS *CORS
+
+	// If set, function calls are protected against cross-site request forgery, see
+	// CSRF.
+	CSRF *CSRF
+
+	// If set, responses are never compressed. Otherwise, responses of at least
+	// CompressMinSize bytes are compressed with gzip or deflate if the request has
+	// an Accept-Encoding header that allows it. Streams are not compressed.
+	NoCompression bool
+
+	// Minimum size in bytes of responses to compress. Defaults to 1024.
+	CompressMinSize int
+
+	// Limits for function call requests, protecting against requests that make the
+	// server allocate lots of memory. Can be overridden per function with
+	// FunctionOpts.Limits.
+	Limits Limits
+
 	// If set, called to create a context to use when calling sherpa functions. If not
 	// set, the HTTP request context is used.
 	NewContext func(req *http.Request, method string, params []any) context.Context
@@ -64,8 +112,148 @@ type HandlerOpts struct {
 	// the result is not logged.
 	// The context from NewContext, or the HTTP request context, is used for logging.
 	Logger *slog.Logger
+
+	// Called around each function call, e.g. for authentication, caching or
+	// auditing. The first interceptor is the outermost: it is called first, and its
+	// "next" calls the second interceptor. The "next" of the last interceptor calls
+	// the function.
+	Interceptors []Interceptor
+
+	// If set, called before each function call, after NewContext. If it returns an
+	// error, the function is not called. An *Error with code UserUnauthorized is
+	// sent with HTTP status 401, other errors are sent as *Error with HTTP status 403,
+	// with code UserForbidden unless the returned *Error has a code.
+	// Policy is the authorization policy for the function, see Policy. Authorize is
+	// not called for functions with PolicyPublic.
+	Authorize func(ctx context.Context, req *http.Request, functionName string, policy Policy) error
+
+	// Authorization policy for the root section, inherited by its functions and
+	// subsections. See Policy.
+	Policy Policy
+
+	// HTTP methods functions in the root section can be called with, inherited by
+	// its functions and subsections. See Methods.
+	Methods Methods
+
+	// Options for individual functions, keyed by function name. NewHandler fails
+	// for names of functions that don't exist.
+	Functions map[string]FunctionOpts
+
+	// If enabled, parameters of function calls are validated against the types in
+	// the sherpadoc documentation before calling the function. Non-nullable values
+	// must not be null, values of Ints and Strings enums must be one of the
+	// documented values, int64s and uint64s must be strings (not numbers), etc.
+	// Violations are returned as SherpaBadParams errors with a JSON path to the
+	// invalid value, e.g. "params[0].Items[1].Name". Functions without documentation
+	// are not validated.
+	ValidateParams bool
+
+	// If enabled, results of function calls are validated against the types in the
+	// sherpadoc documentation, like ValidateParams. Violations are returned as
+	// SherpaBadResult errors.
+	ValidateResults bool
+
+	// If set, POST function calls with an Idempotency-Key header are executed only
+	// once. Successful responses are stored, keyed by function name, idempotency key
+	// and a hash of the parameters. Repeated calls get the stored response, with
+	// header "Idempotent-Replayed: true", without calling the function again. A call
+	// made while a call with the same key is in progress fails with HTTP status 409
+	// and error code SherpaIdempotencyInProgress. Failed calls and streams are not
+	// stored, they can be retried. See NewMemoryIdempotencyStore.
+	//
+	// Authorize is called before a stored response is replayed, so callers not
+	// allowed to call the function get an error. Without IdempotencyScope, stored
+	// responses are shared between all callers allowed to call the function.
+	//
+	// Replayed responses are reported to a ContextCollector through CallStart and
+	// CallDone, but not through Collector.FunctionCall: the function is not called.
+	// Collector.FunctionCall is called if Authorize rejects a replay.
+	IdempotencyStore IdempotencyStore
+
+	// If set, called for POST function calls with an Idempotency-Key header, and
+	// the result is made part of the key for IdempotencyStore. Should return an
+	// identity of the caller, e.g. the user ID, so callers cannot get each other's
+	// stored responses by using the same idempotency key.
+	IdempotencyScope func(req *http.Request) string
+
+	// If set, a span is started for each function call, see Tracer. The trace
+	// context from traceparent and tracestate headers is added to the context of
+	// function calls regardless of Tracer, see TraceContextFrom. Without Tracer,
+	// the trace context is passed through unchanged: calls made with package client
+	// send the span ID of the caller as parent, as if this API were not part of
+	// the trace. A Tracer should set its own span with WithTraceContext.
+	Tracer Tracer
+
+	// MapError is called for errors returned by functions (and interceptors and
+	// Authorize) that are not and do not wrap an *Error or *InternalServerError. It
+	// can map an API's own error types to an *Error with a code (and optionally
+	// details). If MapError is nil or returns nil, the error is returned as an *Error
+	// without code, with the message of the error.
+	MapError func(err error) *Error
+
+	// HTTP status codes for responses with an *Error, keyed by error code, e.g.
+	// http.StatusNotFound for "user:notFound". Overrides the default statuses, which
+	// are 200 for most errors. Not used for errors in batch calls and streams, they
+	// are part of a larger response.
+	ErrorStatus map[string]int
+
+	// If enabled, panics in functions with values other than *Error,
+	// *InternalServerError and Raw are recovered, instead of propagating to the HTTP
+	// server, which closes the connection. The panic value and stack trace are logged
+	// through Logger (or the standard logger if nil) with the function name and the
+	// request ID from the X-Request-Id header (or a random ID), the call is reported
+	// to the Collector with error code ServerPanic, and an error with code
+	// ServerPanic and the request ID is returned with HTTP status 500. Panics while
+	// reading from a stream end the stream with that error.
+	RecoverPanics bool
+
+	// If enabled, an OpenAPI 3.1 document for the API, generated from the
+	// sherpadoc documentation, is served at openapi.json. See package openapi.
+	OpenAPI bool
 }
 
+// FunctionOpts are options for a single function, see HandlerOpts.Functions.
+type FunctionOpts struct {
+	// Authorization policy, overriding the policy of the section of the function.
+	Policy Policy
+
+	// HTTP methods the function can be called with, overriding the methods of the
+	// section of the function. See Methods.
+	Methods Methods
+
+	// Limits for calls to the function. Non-zero limits replace those of
+	// HandlerOpts.Limits.
+	Limits *Limits
+
+	// Error codes the function can return, e.g. "user:notFound". Published in
+	// sherpa.json and the "_docs" function, so clients can handle them. If the
+	// Logger is enabled for level debug, a warning is logged when the function
+	// returns an *Error with a code that was not declared. Errors with codes
+	// generated by the handler, e.g. SherpaBadParams, do not have to be declared.
+	Errors []string
+
+	// Whether calling the function multiple times with the same parameters has the
+	// same effect as calling it once. Published in sherpa.json. Clients can retry
+	// calls to idempotent functions after errors, see the client package.
+	Idempotent bool
+}
+
+// Interceptor wraps a sherpa function call, see HandlerOpts.Interceptors.
+//
+// Ctx is the context for the call, from HandlerOpts.NewContext or the HTTP
+// request. Params are the parsed parameters, excluding a context.Context
+// parameter. Next calls the next interceptor or the function, with the given
+// context. An interceptor can return without calling next, e.g. to deny the call
+// or to return a cached result, and can change the result and error returned by
+// next.
+//
+// The result is nil for functions without return values (not counting an error),
+// the single return value, or a []any for multiple return values. Errors returned
+// by next are of type *Error or *InternalServerError. Other errors returned by an
+// interceptor are turned into an *Error without code. Panics in the function,
+// e.g. with an *Error or Raw, propagate through the interceptors.
+type Interceptor func(ctx context.Context, req *http.Request, functionName string, params []any, next func(ctx context.Context) (result any, err error)) (result any, err error)
+
 // Raw signals a raw JSON response.
 // If a handler panics with this type, the raw bytes are sent (with regular
 // response headers).
@@ -78,17 +266,24 @@ type Raw []byte
 // handler that responds to all Sherpa-related requests.
 type handler struct {
 	path       string
-	functions  map[string]reflect.Value
+	functions  map[string]*function
 	sherpaJSON *JSON
+	docs       *docs
 	opts       HandlerOpts
+	validator  *validator   // For ValidateParams and ValidateResults, nil otherwise.
+	inFlight   atomic.Int64 // Function calls in progress, for ContextCollector.
 }
 
 // Error returned by a function called through a sherpa API.
 // Message is a human-readable error message.
 // Code is optional, it can be used to handle errors programmatically.
+// Details is optional, it is encoded as JSON and can hold structured information
+// about the error, e.g. the fields that failed validation. Package client decodes
+// Details as json.RawMessage.
 type Error struct {
 	Code    string `json:"code"`
 	Message string `json:"message"`
+	Details any    `json:"details,omitempty"`
 }
 
 func (e *Error) Error() string {
@@ -107,7 +302,32 @@ func (e *InternalServerError) Error() string {
 }
 
 func (e *InternalServerError) error() *Error {
-	return &Error{"internalServerError", e.Message}
+	return &Error{Code: ServerError, Message: e.Message}
+}
+
+// function is a sherpa function, with its options.
+type function struct {
+	fn      reflect.Value
+	policy  Policy
+	methods Methods
+	errors  []string // Declared error codes, nil if none declared.
+	limits  *Limits  // From FunctionOpts, nil if not set.
+}
+
+// declared returns whether error code was declared for the function. Codes
+// generated by the handler are always declared.
+func (f *function) declared(code string) bool {
+	if code == "" || strings.HasPrefix(code, "sherpa:") || code == ServerPanic || code == UserUnauthorized || code == UserForbidden {
+		return true
+	}
+	return slices.Contains(f.errors, code)
+}
+
+// docs is the result of the "_docs" function: the sherpadoc documentation, with
+// the error codes declared for functions.
+type docs struct {
+	*sherpadoc.Section
+	Errors map[string][]string `json:",omitempty"` // Keyed by function name.
 }
 
 // Sherpa API response type
@@ -210,7 +430,8 @@ func respond(w http.ResponseWriter, status int, v interface{}, jsonp bool, callb
 // - Raw, for a preformatted JSON response (caught from panic).
 //
 // on error, we always return an Error with the Code field set.
-func (h *handler) call(req *http.Request, functionName string, fn reflect.Value, r io.Reader) (ret interface{}, ee error) {
+func (h *handler) call(w http.ResponseWriter, req *http.Request, functionName string, f *function, r io.Reader, span **traceSpan) (ret interface{}, ee error) {
+	t0 := time.Now()
 	var ctx context.Context
 
 	defer func() {
@@ -224,7 +445,7 @@ func (h *handler) call(req *http.Request, functionName string, fn reflect.Value,
 					} else if se, ok := ee.(*InternalServerError); ok {
 						code, message = se.Code, se.Message
 					} else {
-						code, message = "server:panic", ee.Error()
+						code, message = ServerPanic, ee.Error()
 					}
 					attrs = []slog.Attr{slog.String("errcode", code), slog.String("errmsg", message)}
 				}
@@ -232,6 +453,9 @@ func (h *handler) call(req *http.Request, functionName string, fn reflect.Value,
 					ctx = req.Context()
 					attrs = append(attrs, slog.String("sherpamethod", functionName))
 				}
+				if se, ok := ee.(*Error); ok && f.errors != nil && !f.declared(se.Code) && h.opts.Logger.Enabled(ctx, slog.LevelDebug) {
+					h.opts.Logger.LogAttrs(ctx, slog.LevelWarn, "sherpa function returned undeclared error code", slog.String("sherpamethod", functionName), slog.String("errcode", se.Code))
+				}
 				if ee != nil {
 					h.opts.Logger.LogAttrs(ctx, slog.LevelError, "sherpa error response", attrs...)
 				} else {
@@ -247,10 +471,19 @@ func (h *handler) call(req *http.Request, functionName string, fn reflect.Value,
 			ee = se
 		} else if ierr, ok := e.(*InternalServerError); ok {
 			ee = ierr
+		} else if err, ok := e.(error); ok && wrapsSherpaError(err) {
+			ee = h.sherpaError(err)
 		} else if raw, ok := e.(Raw); ok {
 			ret = raw
+		} else if h.opts.RecoverPanics {
+			xctx := ctx
+			if xctx == nil {
+				xctx = req.Context()
+			}
+			ee = h.recovered(xctx, req, functionName, e)
 		} else {
 			ee = fmt.Errorf("%v", e)
+			(*span).end(ServerPanic)
 			panic(e)
 		}
 	}()
@@ -268,14 +501,55 @@ func (h *handler) call(req *http.Request, functionName string, fn reflect.Value,
 	dec := json.NewDecoder(r)
 	dec.DisallowUnknownFields()
 	err := dec.Decode(&request)
+	if xerr := bodyTooLarge(err); xerr != nil {
+		panic(xerr)
+	}
 	lcheck(err, SherpaBadRequest, "invalid JSON request body")
 
+	fn := f.fn
 	fnt := fn.Type()
 
+	if err := h.limits(f).check(request.Params); err != nil {
+		if se, ok := err.(*Error); ok {
+			panic(se)
+		}
+		lcheck(err, SherpaBadRequest, "invalid JSON request body")
+	}
+
 	var params []interface{}
 	err = json.Unmarshal(request.Params, &params)
 	lcheck(err, SherpaBadRequest, "invalid JSON request body")
 
+	if h.opts.NewContext == nil {
+		ctx = req.Context()
+	} else {
+		ctx = h.opts.NewContext(req, functionName, params)
+	}
+	rh := ResponseHeader{h: w.Header()}
+	if rw, ok := w.(*recordingWriter); ok {
+		rh.record = rw.header
+	}
+	ctx = context.WithValue(ctx, callKey{}, &Call{functionName, request.Params, req, rh})
+	tc, tcok := traceContext(req)
+	if tcok {
+		ctx = WithTraceContext(ctx, tc)
+	}
+	if h.opts.Tracer != nil {
+		var s Span
+		ctx, s = h.opts.Tracer.StartSpan(ctx, functionName, tc, tcok)
+		*span = &traceSpan{span: s, t0: t0}
+	}
+	if h.opts.Logger != nil {
+		h.opts.Logger.Log(ctx, slog.LevelDebug-4, "sherpa request")
+	}
+	if m := callMetrics(req); m != nil && m.Function == functionName {
+		m.Context = ctx
+	}
+
+	if se := h.authorize(ctx, req, functionName, f); se != nil {
+		panic(se)
+	}
+
 	needArgs := fnt.NumIn()
 	needValues := needArgs
 	ctxType := reflect.TypeOf((*context.Context)(nil)).Elem()
@@ -294,13 +568,9 @@ func (h *handler) call(req *http.Request, functionName string, fn reflect.Value,
 	}
 	lcheck(err, SherpaBadParams, "bad number of parameters")
 
-	if h.opts.NewContext == nil {
-		ctx = req.Context()
-	} else {
-		ctx = h.opts.NewContext(req, functionName, params)
-	}
-	if h.opts.Logger != nil {
-		h.opts.Logger.Log(ctx, slog.LevelDebug-4, "sherpa request")
+	if h.opts.ValidateParams {
+		err = h.validator.params(functionName, request.Params)
+		lcheck(err, SherpaBadParams, "invalid parameters")
 	}
 
 	values := make([]reflect.Value, needValues)
@@ -323,6 +593,46 @@ func (h *handler) call(req *http.Request, functionName string, fn reflect.Value,
 	err = dec.Decode(&args)
 	lcheck(err, SherpaBadParams, "parsing parameters")
 
+	// The last interceptor calls the function. Each interceptor gets a "next" that
+	// calls the next interceptor.
+	next := func(ctx context.Context) (interface{}, error) {
+		if needsContext {
+			values[0] = reflect.ValueOf(ctx)
+		}
+		ret, err := callFunction(fn, values)
+		return ret, h.sherpaError(err)
+	}
+	if len(h.opts.Interceptors) > 0 {
+		xparams := make([]any, needArgs)
+		for i := range xparams {
+			xparams[i] = values[o+i].Interface()
+		}
+		for i := len(h.opts.Interceptors) - 1; i >= 0; i-- {
+			intercept, xnext := h.opts.Interceptors[i], next
+			next = func(ctx context.Context) (interface{}, error) {
+				ret, err := intercept(ctx, req, functionName, xparams, xnext)
+				return ret, h.sherpaError(err)
+			}
+		}
+	}
+	if *span != nil {
+		(*span).functionStart = time.Now()
+	}
+	ret, err = next(ctx)
+	if *span != nil {
+		(*span).functionEnd = time.Now()
+	}
+	if err == nil && h.opts.ValidateResults && makeStream(functionName, ret, time.Time{}) == nil {
+		err = h.validator.result(functionName, ret)
+		lcheck(err, SherpaBadResult, "invalid result")
+	}
+	return ret, err
+}
+
+// callFunction calls fn with values and returns its result like call does, and the
+// error returned by fn as is.
+func callFunction(fn reflect.Value, values []reflect.Value) (interface{}, error) {
+	fnt := fn.Type()
 	errorType := reflect.TypeOf((*error)(nil)).Elem()
 	checkError := fnt.NumOut() > 0 && fnt.Out(fnt.NumOut()-1).Implements(errorType)
 
@@ -357,16 +667,229 @@ func (h *handler) call(req *http.Request, functionName string, fn reflect.Value,
 	if rerr == nil {
 		return rv, nil
 	}
-	switch r := rerr.(type) {
+	err, ok := rerr.(error)
+	if !ok {
+		panic("checkError while type is not error")
+	}
+	return nil, err
+}
+
+// wrapsSherpaError returns whether err is or wraps an *Error or *InternalServerError.
+func wrapsSherpaError(err error) bool {
+	var se *Error
+	var ierr *InternalServerError
+	return errors.As(err, &se) || errors.As(err, &ierr)
+}
+
+// sherpaError returns err as *Error or *InternalServerError. For errors wrapping
+// an *Error or *InternalServerError, a copy with the message of err is returned.
+// Other errors are mapped with HandlerOpts.MapError, or turned into an *Error
+// without code.
+func (h *handler) sherpaError(err error) error {
+	switch e := err.(type) {
+	case nil:
+		return nil
 	case *Error:
-		return nil, r
+		return e
+	case *InternalServerError:
+		return e
+	}
+	var se *Error
+	var ierr *InternalServerError
+	if errors.As(err, &se) {
+		return &Error{Code: se.Code, Message: err.Error(), Details: se.Details}
+	} else if errors.As(err, &ierr) {
+		return &InternalServerError{Code: ierr.Code, Message: err.Error()}
+	}
+	if h.opts.MapError != nil {
+		if se := h.opts.MapError(err); se != nil {
+			return se
+		}
+	}
+	return &Error{Message: err.Error()}
+}
+
+// authorize calls HandlerOpts.Authorize for a call of function f, unless it has
+// PolicyPublic. It returns the error for the response if the call is not allowed,
+// with code UserForbidden if Authorize did not return an *Error with a code.
+func (h *handler) authorize(ctx context.Context, req *http.Request, functionName string, f *function) *Error {
+	if h.opts.Authorize == nil || f.policy == PolicyPublic {
+		return nil
+	}
+	err := h.opts.Authorize(ctx, req, functionName, f.policy)
+	if err == nil {
+		return nil
+	}
+	se, ok := h.sherpaError(err).(*Error)
+	if !ok {
+		se = &Error{Message: err.Error()}
+	}
+	if se.Code == "" {
+		se = &Error{Code: UserForbidden, Message: se.Message, Details: se.Details}
+	}
+	return se
+}
+
+// errorStatus returns the HTTP status code for an error response.
+func (h *handler) errorStatus(err *Error) int {
+	if status, ok := h.opts.ErrorStatus[err.Code]; ok {
+		return status
+	}
+	switch err.Code {
+	case UserUnauthorized:
+		return http.StatusUnauthorized
+	case UserForbidden:
+		return http.StatusForbidden
+	case ServerPanic:
+		return http.StatusInternalServerError
+	case SherpaTooLarge:
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusOK
+}
+
+// recovered logs panic value e of a function call with a stack trace, and returns
+// the error for the response. The request ID from the X-Request-Id header is
+// logged and added to the error message, a random ID is used if absent.
+func (h *handler) recovered(ctx context.Context, req *http.Request, functionName string, e any) *Error {
+	id := req.Header.Get("X-Request-Id")
+	if id == "" {
+		buf := make([]byte, 8)
+		cryptorand.Read(buf)
+		id = hex.EncodeToString(buf)
+	}
+	stack := debug.Stack()
+	if h.opts.Logger != nil {
+		h.opts.Logger.LogAttrs(ctx, slog.LevelError, "sherpa function panicked", slog.String("sherpamethod", functionName), slog.String("requestid", id), slog.Any("panic", e), slog.String("stack", string(stack)))
+	} else {
+		log.Printf("sherpa function %q panicked, request id %s: %v\n%s", functionName, id, e, stack)
+	}
+	return &Error{Code: ServerPanic, Message: fmt.Sprintf("function %q panicked, request id %s", functionName, id)}
+}
+
+// callCollect calls fn like call does, and registers the call with the collector.
+// If the function returned a stream, a *stream is returned instead of the result,
+// and the call is registered with the collector when the stream is done.
+func (h *handler) callCollect(w http.ResponseWriter, req *http.Request, functionName string, fn *function, r io.Reader) (interface{}, error) {
+	t0 := time.Now()
+	var span *traceSpan
+	ret, err := h.call(w, req, functionName, fn, r, &span)
+	if err == nil {
+		if s := makeStream(functionName, ret, t0); s != nil {
+			s.span = span
+			return s, nil
+		}
+	}
+	durationSec := float64(time.Since(t0)) / float64(time.Second)
+	var code string
+	switch e := err.(type) {
+	case nil:
 	case *InternalServerError:
-		return nil, r
-	case error:
-		return nil, &Error{Message: r.Error()}
+		code = e.Code
+	case *Error:
+		code = e.Code
 	default:
-		panic("checkError while type is not error")
+		code = ServerPanic
+	}
+	h.opts.Collector.FunctionCall(functionName, durationSec, code)
+	if m := callMetrics(req); m != nil && m.Function == functionName {
+		m.ErrorCode = code
+	}
+	span.end(code)
+	return ret, err
+}
+
+// batchCall is a single function call in a request to "_batch".
+type batchCall struct {
+	Function string          `json:"function"`
+	Params   json.RawMessage `json:"params"`
+}
+
+// batch handles a POST request to "_batch". The request has a single parameter: a
+// list of function calls, each with a function name and parameters. Each call is
+// made in order, the result is a list with a response (result or error) for each
+// call. Calls to the batch are not aborted if one of the calls fails.
+func (h *handler) batch(w http.ResponseWriter, r *http.Request) {
+	collector := h.opts.Collector
+
+	var request struct {
+		Params []json.RawMessage `json:"params"`
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&request); err != nil {
+		collector.ProtocolError()
+		if xerr := bodyTooLarge(err); xerr != nil {
+			respondJSON(w, http.StatusRequestEntityTooLarge, &response{Error: xerr})
+			return
+		}
+		respondJSON(w, 200, &response{Error: &Error{Code: SherpaBadRequest, Message: fmt.Sprintf("batch: invalid JSON request body: %s", err)}})
+		return
+	}
+	if len(request.Params) != 1 {
+		collector.ProtocolError()
+		respondJSON(w, 200, &response{Error: &Error{Code: SherpaBadParams, Message: fmt.Sprintf("batch: bad number of parameters: got %d, want 1", len(request.Params))}})
+		return
+	}
+	var calls []batchCall
+	dec = json.NewDecoder(bytes.NewReader(request.Params[0]))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&calls); err != nil {
+		collector.ProtocolError()
+		respondJSON(w, 200, &response{Error: &Error{Code: SherpaBadParams, Message: fmt.Sprintf("batch: parsing calls: %s", err)}})
+		return
+	}
+	if max := h.opts.Limits.MaxElements; max > 0 && len(calls) > max {
+		collector.ProtocolError()
+		respondJSON(w, http.StatusRequestEntityTooLarge, &response{Error: tooLarge("batch: more than %d calls", max)})
+		return
 	}
+
+	results := make([]response, len(calls))
+	for i, c := range calls {
+		fn, ok := h.functions[c.Function]
+		if !ok {
+			collector.BadFunction()
+			results[i].Error = &Error{Code: SherpaBadFunction, Message: fmt.Sprintf("function %q does not exist", c.Function)}
+			continue
+		}
+		if returnsStream(fn.fn.Type()) {
+			collector.ProtocolError()
+			results[i].Error = &Error{Code: SherpaBadRequest, Message: fmt.Sprintf("function %q returns a stream, cannot be called in a batch", c.Function)}
+			continue
+		}
+
+		params := c.Params
+		if params == nil {
+			params = json.RawMessage("[]")
+		}
+		body, err := json.Marshal(struct {
+			Params json.RawMessage `json:"params"`
+		}{params})
+		if err != nil {
+			results[i].Error = &Error{Code: SherpaBadParams, Message: fmt.Sprintf("function %q: invalid parameters: %s", c.Function, err)}
+			continue
+		}
+		ret, xerr := h.callCollect(w, r, c.Function, fn, bytes.NewReader(body))
+		switch err := xerr.(type) {
+		case nil:
+			if s, ok := ret.(*stream); ok {
+				h.streamDone(r, s, SherpaBadRequest)
+				results[i].Error = &Error{Code: SherpaBadRequest, Message: fmt.Sprintf("function %q returns a stream, cannot be called in a batch", c.Function)}
+			} else if raw, ok := ret.(Raw); ok {
+				results[i].Result = json.RawMessage(raw)
+			} else {
+				results[i].Result = ret
+			}
+		case *InternalServerError:
+			results[i].Error = err.error()
+		case *Error:
+			results[i].Error = err
+		default:
+			panic(err)
+		}
+	}
+	respondJSON(w, 200, &response{Result: results})
 }
 
 func adjustFunctionNameCapitals(s string, opts HandlerOpts) string {
@@ -391,7 +914,7 @@ func adjustFunctionNameCapitals(s string, opts HandlerOpts) string {
 	}
 }
 
-func gatherFunctions(functions map[string]reflect.Value, t reflect.Type, v reflect.Value, opts HandlerOpts) error {
+func gatherFunctions(functions map[string]*function, t reflect.Type, v reflect.Value, opts HandlerOpts, sopts sectionOpts) error {
 	if t.Kind() != reflect.Struct {
 		return fmt.Errorf("sherpa sections must be a struct (is %v)", t)
 	}
@@ -401,14 +924,18 @@ func gatherFunctions(functions map[string]reflect.Value, t reflect.Type, v refle
 		if _, ok := functions[name]; ok {
 			return fmt.Errorf("duplicate function %s", name)
 		}
-		functions[name] = m
+		functions[name] = newFunction(m, opts.Functions[name], sopts)
 	}
 	for i := 0; i < t.NumField(); i++ {
 		f := t.Field(i)
 		if !f.IsExported() {
 			continue
 		}
-		err := gatherFunctions(functions, f.Type, v.Field(i), opts)
+		fsopts, err := parseSectionTag(f.Tag.Get("sherpa"), sopts)
+		if err != nil {
+			return fmt.Errorf("section %s: %v", f.Name, err)
+		}
+		err = gatherFunctions(functions, f.Type, v.Field(i), opts, fsopts)
 		if err != nil {
 			return err
 		}
@@ -416,6 +943,22 @@ func gatherFunctions(functions map[string]reflect.Value, t reflect.Type, v refle
 	return nil
 }
 
+// newFunction returns a function for fn, with options from the section and
+// function options.
+func newFunction(fn reflect.Value, fopts FunctionOpts, sopts sectionOpts) *function {
+	f := &function{fn: fn, policy: sopts.policy, methods: sopts.methods, errors: fopts.Errors, limits: fopts.Limits}
+	if fopts.Policy != "" {
+		f.policy = fopts.Policy
+	}
+	if fopts.Methods != "" {
+		f.methods = fopts.Methods
+	}
+	if f.methods == "" {
+		f.methods = defaultMethods(fn)
+	}
+	return f
+}
+
 // NewHandler returns a new http.Handler that serves all Sherpa API-related requests.
 //
 // Path is the path this API is available at.
@@ -435,6 +978,7 @@ func gatherFunctions(functions map[string]reflect.Value, t reflect.Type, v refle
 // Methods on the exported sections are exported as Sherpa functions.
 // If the first parameter of a method is a context.Context, the context from the HTTP request is passed.
 // This lets you abort work if the HTTP request underlying the function call disappears.
+// Use CallInfo on the context to access the HTTP request and set response headers.
 //
 // Parameters and return values for exported functions are automatically converted from/to JSON.
 // If the last element of a return value (if any) is an error,
@@ -444,6 +988,15 @@ func gatherFunctions(functions map[string]reflect.Value, t reflect.Type, v refle
 //
 // Variadic functions can be called, but in the call (from the client), the variadic parameters must be passed in as an array.
 //
+// Functions can return a stream of results: a receive channel (<-chan T), an
+// iter.Seq[T], or an iter.Seq2[T, error] (where a non-nil error ends the stream
+// with that error). Elements are sent as they become available, as server-sent
+// events, or as newline-delimited JSON if the client sends an "Accept:
+// application/x-ndjson" header. Each element is an object with field "result". The
+// last message is an object with field "end" set to true, and field "error" if the
+// stream failed, e.g. because an iterator panicked with an *Error. Streams are
+// stopped when the HTTP request is canceled.
+//
 // This handler strips "path" from the request.
 func NewHandler(path string, version string, api interface{}, doc *sherpadoc.Section, opts *HandlerOpts) (http.Handler, error) {
 	var xopts HandlerOpts
@@ -457,19 +1010,53 @@ func NewHandler(path string, version string, api interface{}, doc *sherpadoc.Sec
 
 	doc.Version = version
 	doc.SherpaVersion = SherpaVersion
-	functions := map[string]reflect.Value{
-		"_docs": reflect.ValueOf(func() *sherpadoc.Section {
-			return doc
-		}),
+	if err := xopts.Methods.valid(); err != nil {
+		return nil, err
+	}
+	if xopts.CORS != nil {
+		if err := xopts.CORS.check(); err != nil {
+			return nil, err
+		}
+	}
+	sopts := sectionOpts{policy: xopts.Policy, methods: xopts.Methods}
+	xdocs := &docs{Section: doc}
+	docsFn := reflect.ValueOf(func() *docs {
+		return xdocs
+	})
+	functions := map[string]*function{
+		"_docs": newFunction(docsFn, xopts.Functions["_docs"], sopts),
 	}
-	err := gatherFunctions(functions, reflect.TypeOf(api), reflect.ValueOf(api), xopts)
+	err := gatherFunctions(functions, reflect.TypeOf(api), reflect.ValueOf(api), xopts, sopts)
 	if err != nil {
 		return nil, err
 	}
+	var declaredErrors map[string][]string
+	var idempotent []string
+	for name, fopts := range xopts.Functions {
+		if _, ok := functions[name]; !ok {
+			return nil, fmt.Errorf("options for unknown function %q", name)
+		}
+		if err := fopts.Methods.valid(); err != nil {
+			return nil, fmt.Errorf("function %q: %v", name, err)
+		}
+		if fopts.Errors != nil {
+			if declaredErrors == nil {
+				declaredErrors = map[string][]string{}
+			}
+			declaredErrors[name] = fopts.Errors
+		}
+		if fopts.Idempotent {
+			idempotent = append(idempotent, name)
+		}
+	}
+	slices.Sort(idempotent)
+	xdocs.Errors = declaredErrors
 
 	names := make([]string, 0, len(functions))
-	for name := range functions {
+	methods := map[string]Methods{}
+	for name, fn := range functions {
 		names = append(names, name)
+		methods[name] = fn.methods
 	}
 
 	elems := strings.Split(strings.Trim(path, "/"), "/")
@@ -482,20 +1069,72 @@ func NewHandler(path string, version string, api interface{}, doc *sherpadoc.Sec
 		Version:          version,
 		SherpaVersion:    SherpaVersion,
 		SherpadocVersion: doc.SherpadocVersion,
+		Errors:           declaredErrors,
+		Idempotent:       idempotent,
+		IdempotencyKeys:  xopts.IdempotencyStore != nil,
+		Methods:          methods,
+	}
+	if xopts.CSRF != nil {
+		sherpaJSON.CSRF = &JSONCSRF{Header: xopts.CSRF.header(), Cookie: xopts.CSRF.Cookie}
 	}
-	h := http.StripPrefix(path, &handler{
+	hh := &handler{
 		path:       path,
 		functions:  functions,
 		sherpaJSON: sherpaJSON,
+		docs:       xdocs,
 		opts:       xopts,
-	})
+	}
+	if xopts.ValidateParams || xopts.ValidateResults {
+		hh.validator = newValidator(doc)
+	}
+	h := http.StripPrefix(path, hh)
 	return h, nil
 }
 
+// post calls function fn with the JSON request body from r and writes the
+// response. It returns whether the call succeeded with a non-stream result.
+func (h *handler) post(w http.ResponseWriter, req *http.Request, name string, fn *function, r io.Reader) bool {
+	result, xerr := h.callCollect(w, req, name, fn, r)
+	if xerr != nil {
+		switch err := xerr.(type) {
+		case *InternalServerError:
+			respondJSON(w, 500, &response{Error: err.error()})
+		case *Error:
+			respondJSON(w, h.errorStatus(err), &response{Error: err})
+		default:
+			panic(err)
+		}
+		return false
+	} else if s, ok := result.(*stream); ok {
+		h.respondStream(w, req, s)
+		return false
+	}
+	var v interface{}
+	if raw, ok := result.(Raw); ok {
+		v = raw
+	} else {
+		v = &response{Result: result}
+	}
+	respondJSON(w, 200, v)
+	return true
+}
+
 func badMethod(w http.ResponseWriter) {
 	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 }
 
+// respondBadMethod responds to a function call with a method that is not
+// allowed for the function, see Methods. The Allow header lists the HTTP methods
+// of the function, a refused JSONP call may still be allowed as regular GET.
+func respondBadMethod(w http.ResponseWriter, methods Methods, msg string) {
+	if methods == MethodsPOST {
+		w.Header().Set("Allow", "POST")
+	} else {
+		w.Header().Set("Allow", "GET, POST")
+	}
+	respondJSON(w, http.StatusMethodNotAllowed, &response{Error: &Error{Code: SherpaBadMethod, Message: msg}})
+}
+
 // return whether callback js snippet is valid.
 // this is a coarse test.  we disallow some valid js identifiers, like "\u03c0",
 // and we allow many invalid ones, such as js keywords, "0intro" and identifiers starting/ending with ".", or having multiple dots.
@@ -518,17 +1157,28 @@ func validCallback(cb string) bool {
 // The following endpoints are handled:
 //   - sherpa.json, describing this API.
 //   - sherpa.js, a small stand-alone client JavaScript library that makes it trivial to start using this API from a browser.
+//   - docs/, a self-contained page rendering the documentation of this API.
+//   - openapi.json, an OpenAPI document for this API, if the OpenAPI option was set.
 //   - functionName, for function invocations on this API.
+//   - _batch, for calling multiple functions in a single POST request.
 //
-// HTTP response will have CORS-headers set, and support the OPTIONS HTTP method,
-// unless the NoCORS option was set.
+// HTTP response will have CORS-headers set according to the CORS option, and
+// support the OPTIONS HTTP method, unless the NoCORS option was set.
 func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	hdr := w.Header()
-	if !h.opts.NoCORS {
-		hdr.Set("Access-Control-Allow-Origin", "*")
-		hdr.Set("Access-Control-Allow-Methods", "GET, POST")
-		hdr.Set("Access-Control-Allow-Headers", "Content-Type")
+	h.setCORSHeaders(hdr, r)
+	if !h.opts.NoCompression {
+		hdr.Add("Vary", "Accept-Encoding")
+		if enc := acceptEncoding(r.Header.Get("Accept-Encoding")); enc != "" {
+			cw := &compressWriter{ResponseWriter: w, encoding: enc, minSize: cmp.Or(h.opts.CompressMinSize, defaultCompressMinSize)}
+			defer func() {
+				if err := cw.close(); err != nil && !isConnectionClosed(err) {
+					log.Println("writing compressed response:", err)
+				}
+			}()
+			w = cw
+		}
 	}
 
 	collector := h.opts.Collector
@@ -536,7 +1186,8 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch {
 	case r.URL.Path == "":
 		baseURL := getBaseURL(r) + h.path
-		docURL := "https://www.sherpadoc.org/#" + baseURL
+		docURL := baseURL + "docs/"
+		hdr.Set("Content-Type", "text/html; charset=utf-8")
 		err := htmlTemplate.Execute(w, map[string]interface{}{
 			"id":      h.sherpaJSON.ID,
 			"title":   h.sherpaJSON.Title,
@@ -548,12 +1199,43 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			log.Println(err)
 		}
 
+	case r.URL.Path == "docs/":
+		if r.Method != "GET" {
+			badMethod(w)
+			return
+		}
+		hdr.Set("Content-Type", "text/html; charset=utf-8")
+		hdr.Set("Cache-Control", "no-cache")
+		_, err := w.Write(docsHTML)
+		if err != nil && !isConnectionClosed(err) {
+			log.Println("writing docs response:", err)
+		}
+
+	case r.URL.Path == "openapi.json" && h.opts.OpenAPI:
+		if r.Method != "GET" {
+			badMethod(w)
+			return
+		}
+		doc, err := openapi.Convert(h.docs.Section, openapi.Opts{BaseURL: getBaseURL(r) + h.path, Errors: h.docs.Errors})
+		if err != nil {
+			log.Println("generating openapi.json:", err)
+			http.Error(w, "500 - internal server error - generating openapi document failed", http.StatusInternalServerError)
+			return
+		}
+		hdr.Set("Content-Type", "application/json; charset=utf-8")
+		hdr.Set("Cache-Control", "no-cache")
+		err = json.NewEncoder(w).Encode(doc)
+		if err != nil && !isConnectionClosed(err) {
+			log.Println("writing openapi.json response:", err)
+		}
+
 	case r.URL.Path == "sherpa.json":
 		switch {
 		case !h.opts.NoCORS && r.Method == "OPTIONS":
 			w.WriteHeader(204)
 		case r.Method == "GET":
 			collector.JSON()
+			h.setCSRFCookie(w, r)
 			hdr.Set("Content-Type", "application/json; charset=utf-8")
 			hdr.Set("Cache-Control", "no-cache")
 			sherpaJSON := *h.sherpaJSON
@@ -572,6 +1254,7 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		collector.JavaScript()
+		h.setCSRFCookie(w, r)
 		sherpaJSON := *h.sherpaJSON
 		sherpaJSON.BaseURL = getBaseURL(r) + h.path
 		buf, err := json.Marshal(sherpaJSON)
@@ -591,6 +1274,11 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	default:
 		name := r.URL.Path
 		fn, ok := h.functions[name]
+		if cc, ccok := collector.(ContextCollector); ccok && (ok || name == "_batch") && (r.Method == "POST" || r.Method == "GET") {
+			var done func()
+			w, r, done = h.startMetrics(cc, w, r, name)
+			defer done()
+		}
 		switch {
 		case !h.opts.NoCORS && r.Method == "OPTIONS":
 			w.WriteHeader(204)
@@ -598,12 +1286,18 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		case r.Method == "POST":
 			hdr.Set("Cache-Control", "no-store")
 
-			if !ok {
+			if !ok && name != "_batch" {
 				collector.BadFunction()
 				respondJSON(w, 404, &response{Error: &Error{Code: SherpaBadFunction, Message: fmt.Sprintf("function %q does not exist", name)}})
 				return
 			}
 
+			if !h.checkCSRF(r, name) {
+				collector.ProtocolError()
+				respondJSON(w, http.StatusForbidden, &response{Error: &Error{Code: SherpaCSRF, Message: "missing or invalid csrf token"}})
+				return
+			}
+
 			ct := r.Header.Get("Content-Type")
 			if ct == "" {
 				collector.ProtocolError()
@@ -627,32 +1321,21 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			t0 := time.Now()
-			r, xerr := h.call(r, name, fn, r.Body)
-			durationSec := float64(time.Since(t0)) / float64(time.Second)
-			if xerr != nil {
-				switch err := xerr.(type) {
-				case *InternalServerError:
-					collector.FunctionCall(name, durationSec, err.Code)
-					respondJSON(w, 500, &response{Error: err.error()})
-				case *Error:
-					collector.FunctionCall(name, durationSec, err.Code)
-					respondJSON(w, 200, &response{Error: err})
-				default:
-					collector.FunctionCall(name, durationSec, "server:panic")
-					panic(err)
-				}
-			} else {
-				var v interface{}
-				if raw, rok := r.(Raw); rok {
-					v = raw
-				} else {
-					v = &response{Result: r}
-				}
-				collector.FunctionCall(name, durationSec, "")
-				respondJSON(w, 200, v)
+			if max := h.limits(fn).MaxBodyBytes; max > 0 {
+				r.Body = http.MaxBytesReader(w, r.Body, max)
+			}
+
+			if name == "_batch" {
+				h.batch(w, r)
+				return
 			}
 
+			if key := r.Header.Get("Idempotency-Key"); key != "" && h.opts.IdempotencyStore != nil {
+				h.idempotentCall(w, r, name, fn, key)
+				return
+			}
+			h.post(w, r, name, fn, r.Body)
+
 		case r.Method == "GET":
 			hdr.Set("Cache-Control", "no-store")
 
@@ -663,6 +1346,18 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
+			if fn.methods == MethodsPOST {
+				collector.ProtocolError()
+				respondBadMethod(w, fn.methods, fmt.Sprintf("function %q can only be called with POST", name))
+				return
+			}
+
+			if !h.checkCSRF(r, name) {
+				collector.ProtocolError()
+				respondJSON(w, http.StatusForbidden, &response{Error: &Error{Code: SherpaCSRF, Message: "cross-site call not allowed"}})
+				return
+			}
+
 			err := r.ParseForm()
 			if err != nil {
 				collector.ProtocolError()
@@ -678,7 +1373,20 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 					respondJSON(w, 200, &response{Error: &Error{Code: SherpaBadRequest, Message: fmt.Sprintf(`invalid callback name %q`, callback)}})
 					return
 				}
+				if fn.methods != MethodsJSONP {
+					collector.ProtocolError()
+					respondBadMethod(w, fn.methods, fmt.Sprintf("function %q cannot be called with jsonp", name))
+					return
+				}
+				if returnsStream(fn.fn.Type()) {
+					collector.ProtocolError()
+					respond(w, 200, &response{Error: &Error{Code: SherpaBadRequest, Message: fmt.Sprintf("function %q returns a stream, cannot be called with jsonp", name)}}, true, callback)
+					return
+				}
 				jsonp = true
+				if m := callMetrics(r); m != nil {
+					m.Transport = "JSONP"
+				}
 			}
 
 			// We allow an empty list to be missing to make it cleaner & easier to call health check functions (no ugly urls).
@@ -687,22 +1395,30 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			if !ok {
 				body = `{"params": []}`
 			}
+			if max := h.limits(fn).MaxBodyBytes; max > 0 && int64(len(body)) > max {
+				collector.ProtocolError()
+				respond(w, http.StatusRequestEntityTooLarge, &response{Error: tooLarge("request body larger than %d bytes", max)}, jsonp, callback)
+				return
+			}
 
-			t0 := time.Now()
-			r, xerr := h.call(r, name, fn, strings.NewReader(body))
-			durationSec := float64(time.Since(t0)) / float64(time.Second)
+			req := r
+			r, xerr := h.callCollect(w, r, name, fn, strings.NewReader(body))
+			if s, sok := r.(*stream); sok && jsonp {
+				h.streamDone(req, s, SherpaBadRequest)
+				respond(w, 200, &response{Error: &Error{Code: SherpaBadRequest, Message: fmt.Sprintf("function %q returns a stream, cannot be called with jsonp", name)}}, jsonp, callback)
+				return
+			}
 			if xerr != nil {
 				switch err := xerr.(type) {
 				case *InternalServerError:
-					collector.FunctionCall(name, durationSec, err.Code)
 					respond(w, 500, &response{Error: err.error()}, jsonp, callback)
 				case *Error:
-					collector.FunctionCall(name, durationSec, err.Code)
-					respond(w, 200, &response{Error: err}, jsonp, callback)
+					respond(w, h.errorStatus(err), &response{Error: err}, jsonp, callback)
 				default:
-					collector.FunctionCall(name, durationSec, "server:panic")
 					panic(err)
 				}
+			} else if s, sok := r.(*stream); sok {
+				h.respondStream(w, req, s)
 			} else {
 				var v interface{}
 				if raw, ok := r.(Raw); ok {
@@ -710,7 +1426,6 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				} else {
 					v = &response{Result: r}
 				}
-				collector.FunctionCall(name, durationSec, "")
 				respond(w, 200, v, jsonp, callback)
 			}
 
@@ -0,0 +1,772 @@
+package sherpa
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/sherpadoc"
+)
+
+type exampleAPI struct {
+	Admin adminAPI `sherpa:"policy=role:admin"`
+}
+
+type adminAPI struct {
+}
+
+func (adminAPI) Reset() {
+}
+
+func (exampleAPI) Sum(a, b int) int {
+	return a + b
+}
+
+func (exampleAPI) Fail(code string) error {
+	return &Error{Code: code, Message: "failed"}
+}
+
+func (exampleAPI) Count(n int) <-chan int {
+	c := make(chan int)
+	go func() {
+		defer close(c)
+		for i := range n {
+			c <- i
+		}
+	}()
+	return c
+}
+
+func (exampleAPI) Seq(n int) iter.Seq2[int, error] {
+	return func(yield func(int, error) bool) {
+		for i := range n {
+			if !yield(i, nil) {
+				return
+			}
+		}
+		yield(0, &Error{Code: "user:done", Message: "done"})
+	}
+}
+
+type notFoundError struct {
+	id int
+}
+
+func (e notFoundError) Error() string {
+	return fmt.Sprintf("item %d not found", e.id)
+}
+
+func (exampleAPI) Get(id int) error {
+	switch id {
+	case 1:
+		return fmt.Errorf("get: %w", &Error{Code: "user:invalid", Message: "invalid", Details: map[string]string{"field": "id"}})
+	case 2:
+		return fmt.Errorf("get: %w", notFoundError{id})
+	}
+	return nil
+}
+
+func (exampleAPI) Whoami(ctx context.Context, name string) (string, error) {
+	c := CallInfo(ctx)
+	c.ResponseHeader.SetCookie(&http.Cookie{Name: "name", Value: name})
+	if err := c.ResponseHeader.Set("Content-Type", "text/plain"); err == nil {
+		return "", fmt.Errorf("content-type can be changed")
+	}
+	return fmt.Sprintf("%s %s %s", c.Function, c.Params, c.Request.Header.Get("X-Test")), nil
+}
+
+func (exampleAPI) Crash() {
+	panic("crash")
+}
+
+type countCollector struct {
+	ignoreCollector
+	calls       []string
+	badFunction int
+}
+
+func (c *countCollector) BadFunction() {
+	c.badFunction++
+}
+
+func (c *countCollector) FunctionCall(name string, durationSec float64, errorCode string) {
+	c.calls = append(c.calls, name+":"+errorCode)
+}
+
+func post(t *testing.T, h http.Handler, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest("POST", path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	return resp
+}
+
+func TestBatch(t *testing.T) {
+	collector := &countCollector{}
+	h, err := NewHandler("/", "0.0.1", exampleAPI{}, &sherpadoc.Section{}, &HandlerOpts{Collector: collector})
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+
+	resp := post(t, h, "/_batch", `{"params": [[{"function": "sum", "params": [1, 2]}, {"function": "fail", "params": ["user:test"]}, {"function": "bogus", "params": []}, {"function": "sum", "params": [1]}, {"function": "count", "params": [1]}]]}`)
+	if resp.Code != 200 {
+		t.Fatalf("batch call, got status %d, expected 200", resp.Code)
+	}
+	var result struct {
+		Result []struct {
+			Result json.RawMessage
+			Error  *Error
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("parsing batch response: %v", err)
+	}
+	if len(result.Result) != 5 {
+		t.Fatalf("got %d results, expected 5", len(result.Result))
+	}
+	if string(result.Result[0].Result) != "3" || result.Result[0].Error != nil {
+		t.Fatalf("bad result for sum, got %s, %v", result.Result[0].Result, result.Result[0].Error)
+	}
+	expCodes := []string{"", "user:test", SherpaBadFunction, SherpaBadParams, SherpaBadRequest}
+	for i, code := range expCodes[1:] {
+		if e := result.Result[i+1].Error; e == nil || e.Code != code {
+			t.Fatalf("result %d: got error %v, expected code %q", i+1, e, code)
+		}
+	}
+
+	expCalls := "sum:,fail:user:test,sum:sherpa:badParams"
+	if calls := strings.Join(collector.calls, ","); calls != expCalls {
+		t.Fatalf("collector function calls, got %q, expected %q", calls, expCalls)
+	}
+	if collector.badFunction != 1 {
+		t.Fatalf("collector bad functions, got %d, expected 1", collector.badFunction)
+	}
+
+	resp = post(t, h, "/_batch", `{"params": []}`)
+	var eresult struct {
+		Error *Error
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&eresult); err != nil {
+		t.Fatalf("parsing batch response: %v", err)
+	}
+	if eresult.Error == nil || eresult.Error.Code != SherpaBadParams {
+		t.Fatalf("batch without calls, got error %v, expected %q", eresult.Error, SherpaBadParams)
+	}
+}
+
+func TestStream(t *testing.T) {
+	collector := &countCollector{}
+	opts := &HandlerOpts{Collector: collector, Functions: map[string]FunctionOpts{"count": {Methods: MethodsJSONP}}}
+	h, err := NewHandler("/", "0.0.1", exampleAPI{}, &sherpadoc.Section{}, opts)
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/count", strings.NewReader(`{"params": [3]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/x-ndjson")
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	exp := `{"result":0}` + "\n" + `{"result":1}` + "\n" + `{"result":2}` + "\n" + `{"end":true}` + "\n"
+	if got := resp.Body.String(); got != exp {
+		t.Fatalf("ndjson stream, got %q, expected %q", got, exp)
+	}
+
+	resp = post(t, h, "/seq", `{"params": [1]}`)
+	if ct := resp.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Fatalf("got content-type %q, expected text/event-stream", ct)
+	}
+	exp = "data: " + `{"result":0}` + "\n\n" + "data: " + `{"end":true,"error":{"code":"user:done","message":"done"}}` + "\n\n"
+	if got := resp.Body.String(); got != exp {
+		t.Fatalf("sse stream, got %q, expected %q", got, exp)
+	}
+
+	// Streams cannot be called with JSONP, the function is not called.
+	collector.calls = nil
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest("GET", `/count?callback=cb&body={"params":[1]}`, nil))
+	if !strings.Contains(resp.Body.String(), SherpaBadRequest) || len(collector.calls) != 0 {
+		t.Fatalf("jsonp call of stream, got response %q, calls %v", resp.Body.String(), collector.calls)
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	var order []string
+	intercept := func(name string) Interceptor {
+		return func(ctx context.Context, req *http.Request, functionName string, params []any, next func(ctx context.Context) (any, error)) (any, error) {
+			order = append(order, name)
+			if functionName == "sum" && params[0].(int) < 0 {
+				return nil, &Error{Code: "user:negative", Message: "negative"}
+			}
+			ret, err := next(ctx)
+			if functionName == "sum" && err == nil {
+				ret = ret.(int) * 10
+			}
+			return ret, err
+		}
+	}
+	opts := &HandlerOpts{Interceptors: []Interceptor{intercept("a"), intercept("b")}}
+	h, err := NewHandler("/", "0.0.1", exampleAPI{}, &sherpadoc.Section{}, opts)
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+
+	resp := post(t, h, "/sum", `{"params": [1, 2]}`)
+	if got, exp := resp.Body.String(), `{"result":300}`+"\n"; got != exp {
+		t.Fatalf("sum, got %q, expected %q", got, exp)
+	}
+	if got := strings.Join(order, ","); got != "a,b" {
+		t.Fatalf("interceptor order, got %q, expected a,b", got)
+	}
+
+	order = nil
+	resp = post(t, h, "/sum", `{"params": [-1, 2]}`)
+	if got, exp := resp.Body.String(), `{"result":null,"error":{"code":"user:negative","message":"negative"}}`+"\n"; got != exp {
+		t.Fatalf("sum, got %q, expected %q", got, exp)
+	}
+	if got := strings.Join(order, ","); got != "a" {
+		t.Fatalf("interceptor order, got %q, expected a", got)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	var policies []string
+	opts := &HandlerOpts{
+		Policy: PolicyAuthenticated,
+		Authorize: func(ctx context.Context, req *http.Request, functionName string, policy Policy) error {
+			policies = append(policies, functionName+":"+string(policy))
+			switch {
+			case req.Header.Get("Authorization") == "":
+				return &Error{Code: UserUnauthorized, Message: "not authenticated"}
+			case policy.Role() != "" && req.Header.Get("Authorization") != policy.Role():
+				return fmt.Errorf("missing role %q", policy.Role())
+			}
+			return nil
+		},
+		Functions: map[string]FunctionOpts{
+			"sum": {Policy: PolicyPublic},
+		},
+	}
+	h, err := NewHandler("/", "0.0.1", exampleAPI{}, &sherpadoc.Section{}, opts)
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+
+	call := func(path, auth string, expStatus int, expCode string) {
+		t.Helper()
+		req := httptest.NewRequest("POST", path, strings.NewReader(`{"params": []}`))
+		req.Header.Set("Content-Type", "application/json")
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		if resp.Code != expStatus {
+			t.Fatalf("%s: got status %d, expected %d", path, resp.Code, expStatus)
+		}
+		var result struct {
+			Error *Error
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatalf("parsing response: %v", err)
+		}
+		if expCode == "" && result.Error != nil || expCode != "" && (result.Error == nil || result.Error.Code != expCode) {
+			t.Fatalf("%s: got error %v, expected code %q", path, result.Error, expCode)
+		}
+	}
+
+	call("/reset", "", 401, UserUnauthorized)
+	call("/reset", "user", 403, UserForbidden)
+	call("/reset", "admin", 200, "")
+	call("/count", "", 401, UserUnauthorized)
+	call("/sum", "", 200, SherpaBadParams)
+
+	exp := "reset:role:admin,reset:role:admin,reset:role:admin,count:authenticated"
+	if got := strings.Join(policies, ","); got != exp {
+		t.Fatalf("authorize calls, got %q, expected %q", got, exp)
+	}
+
+	_, err = NewHandler("/", "0.0.1", exampleAPI{}, &sherpadoc.Section{}, &HandlerOpts{Functions: map[string]FunctionOpts{"bogus": {}}})
+	if err == nil {
+		t.Fatalf("NewHandler with options for unknown function succeeded")
+	}
+}
+
+func TestDeclaredErrors(t *testing.T) {
+	opts := &HandlerOpts{
+		Functions: map[string]FunctionOpts{
+			"fail": {Errors: []string{"user:test"}},
+		},
+	}
+	h, err := NewHandler("/", "0.0.1", exampleAPI{}, &sherpadoc.Section{Name: "Example"}, opts)
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest("GET", "/sherpa.json", nil))
+	var sherpaJSON JSON
+	if err := json.NewDecoder(resp.Body).Decode(&sherpaJSON); err != nil {
+		t.Fatalf("parsing sherpa.json: %v", err)
+	}
+	if codes := sherpaJSON.Errors["fail"]; len(codes) != 1 || codes[0] != "user:test" {
+		t.Fatalf("sherpa.json errors, got %v, expected user:test for fail", sherpaJSON.Errors)
+	}
+
+	resp = post(t, h, "/_docs", `{"params": []}`)
+	var result struct {
+		Result struct {
+			Name   string
+			Errors map[string][]string
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("parsing _docs: %v", err)
+	}
+	if result.Result.Name != "Example" || len(result.Result.Errors["fail"]) != 1 {
+		t.Fatalf("_docs, got %v, expected name and errors", result.Result)
+	}
+}
+
+func TestDocs(t *testing.T) {
+	h, err := NewHandler("/", "0.0.1", exampleAPI{}, &sherpadoc.Section{Name: "Example"}, nil)
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+
+	get := func(method, path string, expStatus int) *httptest.ResponseRecorder {
+		t.Helper()
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, httptest.NewRequest(method, path, nil))
+		if resp.Code != expStatus {
+			t.Fatalf("%s %s: got status %d, expected %d", method, path, resp.Code, expStatus)
+		}
+		return resp
+	}
+
+	// The page is self-contained, it has no separate assets, and fetches the
+	// documentation through the _docs function.
+	resp := get("GET", "/docs/", 200)
+	if ct := resp.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Fatalf("docs/: got content-type %q", ct)
+	}
+	if body := resp.Body.String(); !strings.Contains(body, "<html") || !strings.Contains(body, "../_docs") {
+		t.Fatalf("docs/: unexpected page:\n%s", body)
+	}
+	get("POST", "/docs/", http.StatusMethodNotAllowed)
+	get("GET", "/docs/index.html", 404)
+	get("GET", "/docs/script.js", 404)
+	get("GET", "/docs", 404)
+
+	resp = get("GET", "/", 200)
+	if !strings.Contains(resp.Body.String(), "http://example.com/docs/") {
+		t.Fatalf("index: missing link to docs/:\n%s", resp.Body.String())
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	collector := &countCollector{}
+	var logBuf strings.Builder
+	logger := slog.New(slog.NewTextHandler(&logBuf, nil))
+	h, err := NewHandler("/", "0.0.1", exampleAPI{}, &sherpadoc.Section{}, &HandlerOpts{Collector: collector, Logger: logger, RecoverPanics: true})
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/crash", strings.NewReader(`{"params": []}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Request-Id", "req1")
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	var result struct {
+		Error *Error
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("parsing response: %v", err)
+	}
+	if resp.Code != http.StatusInternalServerError || result.Error == nil || result.Error.Code != ServerPanic || !strings.Contains(result.Error.Message, "req1") {
+		t.Fatalf("got status %d, error %v, expected status 500 with server:panic error", resp.Code, result.Error)
+	}
+	if len(collector.calls) != 1 || collector.calls[0] != "crash:"+ServerPanic {
+		t.Fatalf("got collector calls %v", collector.calls)
+	}
+	if s := logBuf.String(); !strings.Contains(s, "requestid=req1") || !strings.Contains(s, "stack=") {
+		t.Fatalf("missing request id or stack in log:\n%s", s)
+	}
+}
+
+func TestErrorMapping(t *testing.T) {
+	opts := &HandlerOpts{
+		MapError: func(err error) *Error {
+			var nf notFoundError
+			if errors.As(err, &nf) {
+				return &Error{Code: "user:notFound", Message: err.Error(), Details: nf.id}
+			}
+			return nil
+		},
+		ErrorStatus: map[string]int{"user:notFound": http.StatusNotFound},
+	}
+	h, err := NewHandler("/", "0.0.1", exampleAPI{}, &sherpadoc.Section{}, opts)
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+
+	test := func(body string, expStatus int, expError string) {
+		t.Helper()
+		resp := post(t, h, "/get", body)
+		if resp.Code != expStatus || strings.TrimSpace(resp.Body.String()) != expError {
+			t.Fatalf("%s: got status %d, body %s, expected status %d, body %s", body, resp.Code, resp.Body.String(), expStatus, expError)
+		}
+	}
+	test(`{"params": [1]}`, 200, `{"result":null,"error":{"code":"user:invalid","message":"get: invalid","details":{"field":"id"}}}`)
+	test(`{"params": [2]}`, 404, `{"result":null,"error":{"code":"user:notFound","message":"get: item 2 not found","details":2}}`)
+	test(`{"params": [3]}`, 200, `{"result":null}`)
+}
+
+type metricsCollector struct {
+	ignoreCollector
+	started, done []CallMetrics
+}
+
+func (c *metricsCollector) CallStart(m CallMetrics) {
+	c.started = append(c.started, m)
+}
+
+func (c *metricsCollector) CallDone(m CallMetrics) {
+	c.done = append(c.done, m)
+}
+
+func TestContextCollector(t *testing.T) {
+	type key struct{}
+	collector := &metricsCollector{}
+	opts := &HandlerOpts{
+		Collector: collector,
+		NewContext: func(req *http.Request, method string, params []any) context.Context {
+			return context.WithValue(req.Context(), key{}, method)
+		},
+		ErrorStatus: map[string]int{"user:x": http.StatusBadRequest},
+		Functions:   map[string]FunctionOpts{"fail": {Methods: MethodsJSONP}},
+	}
+	h, err := NewHandler("/", "0.0.1", exampleAPI{}, &sherpadoc.Section{}, opts)
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+
+	body := `{"params": [1, 2]}`
+	resp := post(t, h, "/sum", body)
+	m := collector.done[0]
+	if len(collector.started) != 1 || collector.started[0].InFlight != 1 || m.InFlight != 0 {
+		t.Fatalf("got start %v, done %v, expected in flight 1 and 0", collector.started, m)
+	}
+	if m.Function != "sum" || m.Transport != "POST" || m.Status != 200 || m.ErrorCode != "" || m.RequestSize != int64(len(body)) || m.ResponseSize != int64(resp.Body.Len()) || m.Context.Value(key{}) != "sum" {
+		t.Fatalf("bad metrics %#v", m)
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", `/fail?callback=cb&body={"params":["user:x"]}`, nil))
+	m = collector.done[1]
+	if m.Function != "fail" || m.Transport != "JSONP" || m.Status != http.StatusBadRequest || m.ErrorCode != "user:x" {
+		t.Fatalf("bad metrics %#v", m)
+	}
+}
+
+type methodsAPI struct {
+	exampleAPI
+	Admin adminAPI `sherpa:"methods=get"`
+}
+
+func TestMethods(t *testing.T) {
+	opts := &HandlerOpts{
+		Functions: map[string]FunctionOpts{"sum": {Methods: MethodsGET}},
+	}
+	h, err := NewHandler("/", "0.0.1", methodsAPI{}, &sherpadoc.Section{}, opts)
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+
+	get := func(path string, expStatus int, expCode, expAllow string) {
+		t.Helper()
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, httptest.NewRequest("GET", path, nil))
+		if resp.Code != expStatus {
+			t.Fatalf("get %s: got status %d, expected %d", path, resp.Code, expStatus)
+		}
+		if allow := resp.Header().Get("Allow"); allow != expAllow {
+			t.Fatalf("get %s: got allow header %q, expected %q", path, allow, expAllow)
+		}
+		if expCode == "" {
+			return
+		}
+		var r struct{ Error *Error }
+		if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+			t.Fatalf("get %s: parsing response: %v", path, err)
+		}
+		if r.Error == nil || r.Error.Code != expCode {
+			t.Fatalf("get %s: got error %v, expected code %q", path, r.Error, expCode)
+		}
+	}
+	get(`/sum?body={"params":[1,2]}`, 200, "", "")
+	get(`/sum?callback=cb&body={"params":[1,2]}`, http.StatusMethodNotAllowed, SherpaBadMethod, "GET, POST")
+	get(`/fail?body={"params":[""]}`, http.StatusMethodNotAllowed, SherpaBadMethod, "POST")
+	get(`/_docs?callback=cb`, 200, "", "") // Without parameters, JSONP is allowed.
+	get(`/reset?callback=cb`, http.StatusMethodNotAllowed, SherpaBadMethod, "GET, POST")
+	get(`/reset`, 200, "", "")
+
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest("GET", "/sherpa.json", nil))
+	var sherpaJSON JSON
+	if err := json.NewDecoder(resp.Body).Decode(&sherpaJSON); err != nil {
+		t.Fatalf("parsing sherpa.json: %v", err)
+	}
+	if m := sherpaJSON.Methods; m["sum"] != MethodsGET || m["fail"] != MethodsPOST || m["_docs"] != MethodsJSONP || m["reset"] != MethodsGET {
+		t.Fatalf("sherpa.json methods, got %v", m)
+	}
+
+	_, err = NewHandler("/", "0.0.1", exampleAPI{}, &sherpadoc.Section{}, &HandlerOpts{Methods: "put"})
+	if err == nil {
+		t.Fatalf("NewHandler with bad methods succeeded")
+	}
+}
+
+func TestCORS(t *testing.T) {
+	opts := &HandlerOpts{
+		CORS: &CORS{
+			AllowOrigins:     []string{"https://app.example"},
+			AllowOrigin:      func(origin string) bool { return strings.HasSuffix(origin, ".example.org") },
+			AllowCredentials: true,
+			AllowHeaders:     []string{"traceparent"},
+			ExposeHeaders:    []string{"Idempotent-Replayed"},
+			MaxAge:           time.Hour,
+		},
+	}
+	h, err := NewHandler("/", "0.0.1", exampleAPI{}, &sherpadoc.Section{}, opts)
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+
+	preflight := func(origin string) http.Header {
+		t.Helper()
+		req := httptest.NewRequest("OPTIONS", "/sum", nil)
+		req.Header.Set("Origin", origin)
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		if resp.Code != 204 {
+			t.Fatalf("preflight: got status %d, expected 204", resp.Code)
+		}
+		return resp.Header()
+	}
+	hdr := preflight("https://app.example")
+	if hdr.Get("Access-Control-Allow-Origin") != "https://app.example" || hdr.Get("Access-Control-Allow-Credentials") != "true" || hdr.Get("Access-Control-Allow-Headers") != "Content-Type, traceparent" || hdr.Get("Access-Control-Expose-Headers") != "Idempotent-Replayed" || hdr.Get("Access-Control-Max-Age") != "3600" || hdr.Get("Vary") != "Origin" {
+		t.Fatalf("bad preflight headers %v", hdr)
+	}
+	if hdr := preflight("https://sub.example.org"); hdr.Get("Access-Control-Allow-Origin") != "https://sub.example.org" {
+		t.Fatalf("origin allowed by function, got headers %v", hdr)
+	}
+	if hdr := preflight("https://evil.example"); hdr.Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("origin not allowed, got headers %v", hdr)
+	}
+
+	_, err = NewHandler("/", "0.0.1", exampleAPI{}, &sherpadoc.Section{}, &HandlerOpts{CORS: &CORS{AllowOrigins: []string{"*"}, AllowCredentials: true}})
+	if err == nil {
+		t.Fatalf("NewHandler with credentials for all origins succeeded")
+	}
+
+	h, err = NewHandler("/", "0.0.1", exampleAPI{}, &sherpadoc.Section{}, nil)
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+	resp := post(t, h, "/sum", `{"params": [1, 2]}`)
+	if resp.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatalf("default policy, got headers %v", resp.Header())
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	opts := &HandlerOpts{
+		CSRF:      &CSRF{Cookie: "csrf", TrustedOrigins: []string{"https://app.example"}},
+		Functions: map[string]FunctionOpts{"sum": {Methods: MethodsJSONP}},
+	}
+	h, err := NewHandler("/", "0.0.1", exampleAPI{}, &sherpadoc.Section{}, opts)
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest("GET", "/sherpa.js", nil))
+	cookies := resp.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "csrf" || cookies[0].Value == "" {
+		t.Fatalf("sherpa.js, got cookies %v, expected csrf cookie", cookies)
+	}
+	token := cookies[0].Value
+
+	call := func(method, path string, hdr map[string]string, expStatus int) {
+		t.Helper()
+		var body io.Reader
+		if method == "POST" {
+			body = strings.NewReader(`{"params": [1, 2]}`)
+		}
+		req := httptest.NewRequest(method, path, body)
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		if resp.Code != expStatus {
+			t.Fatalf("%s %s with %v: got status %d, expected %d", method, path, hdr, resp.Code, expStatus)
+		}
+	}
+	call("POST", "/sum", nil, http.StatusForbidden)
+	call("POST", "/sum", map[string]string{"X-Sherpa-CSRF": token}, http.StatusForbidden)
+	call("POST", "/sum", map[string]string{"X-Sherpa-CSRF": "bogus", "Cookie": "csrf=" + token}, http.StatusForbidden)
+	call("POST", "/sum", map[string]string{"X-Sherpa-CSRF": token, "Cookie": "csrf=" + token}, 200)
+
+	// Generated TypeScript clients don't load sherpa.js, they get the cookie from
+	// sherpa.json.
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest("GET", "/sherpa.json", nil))
+	cookies = resp.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "csrf" || cookies[0].Value == "" {
+		t.Fatalf("sherpa.json, got cookies %v, expected csrf cookie", cookies)
+	}
+	call("POST", "/sum", map[string]string{"X-Sherpa-CSRF": cookies[0].Value, "Cookie": "csrf=" + cookies[0].Value}, 200)
+	call("POST", "/_docs", nil, 200)
+
+	get := `/sum?callback=cb&body={"params":[1,2]}`
+	call("GET", get, nil, 200)
+	call("GET", get, map[string]string{"Sec-Fetch-Site": "same-origin"}, 200)
+	call("GET", get, map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden)
+	call("GET", get, map[string]string{"Origin": "https://evil.example"}, http.StatusForbidden)
+	call("GET", get, map[string]string{"Origin": "https://app.example"}, 200)
+	call("GET", get, map[string]string{"Origin": "http://example.com"}, 200)
+	call("GET", get, map[string]string{"Origin": "https://example.com"}, http.StatusForbidden)
+	call("GET", get, map[string]string{"Origin": "https://api.example", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "api.example"}, 200)
+	call("GET", get, map[string]string{"Origin": "http://api.example", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "api.example"}, http.StatusForbidden)
+
+	// Same origin over TLS, without reverse proxy.
+	req := httptest.NewRequest("GET", "https://example.com"+get, nil)
+	req.Header.Set("Origin", "https://example.com")
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	if resp.Code != 200 {
+		t.Fatalf("same-origin GET over TLS: got status %d, expected 200", resp.Code)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	opts := &HandlerOpts{
+		Limits: Limits{MaxBodyBytes: 100, MaxDepth: 2, MaxElements: 3, MaxStringLength: 5},
+		Functions: map[string]FunctionOpts{
+			"fail": {Limits: &Limits{MaxStringLength: 10}},
+		},
+	}
+	h, err := NewHandler("/", "0.0.1", exampleAPI{}, &sherpadoc.Section{}, opts)
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+
+	call := func(path, body string, expStatus int, expCode string) {
+		t.Helper()
+		resp := post(t, h, path, body)
+		var r struct{ Error *Error }
+		if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+			t.Fatalf("%s: parsing response: %v", path, err)
+		}
+		if resp.Code != expStatus || expCode == "" && r.Error != nil || expCode != "" && (r.Error == nil || r.Error.Code != expCode) {
+			t.Fatalf("%s %s: got status %d, error %v, expected status %d, code %q", path, body, resp.Code, r.Error, expStatus, expCode)
+		}
+	}
+	call("/sum", `{"params": [1, 2]}`, 200, "")
+	call("/sum", `{"params": [1, 2, 3, 4]}`, http.StatusRequestEntityTooLarge, SherpaTooLarge)
+	call("/sum", `{"params": [[[1]], 2]}`, http.StatusRequestEntityTooLarge, SherpaTooLarge)
+	call("/sum", `{"params": [1,`+strings.Repeat(" ", 100)+`2]}`, http.StatusRequestEntityTooLarge, SherpaTooLarge)
+	call("/fail", `{"params": ["user:toolong"]}`, http.StatusRequestEntityTooLarge, SherpaTooLarge)
+	call("/fail", `{"params": ["user:x"]}`, 200, "user:x")
+	call("/_batch", `{"params": [[{"function": "sum", "params": [1, 2, 3, 4]}]]}`, 200, "")
+	call("/_batch", `{"params": [[{"function": "sum"}, {"function": "sum"}, {"function": "sum"}, {"function": "sum"}]]}`, http.StatusRequestEntityTooLarge, SherpaTooLarge)
+}
+
+func TestCompression(t *testing.T) {
+	h, err := NewHandler("/", "0.0.1", exampleAPI{}, &sherpadoc.Section{}, nil)
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+
+	get := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		if resp.Header().Get("Vary") != "Accept-Encoding" {
+			t.Fatalf("%s: missing vary header, got headers %v", path, resp.Header())
+		}
+		return resp
+	}
+
+	resp := get("/sherpa.js", "deflate;q=0.5, gzip")
+	if resp.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("sherpa.js: got headers %v, expected gzip", resp.Header())
+	}
+	gzr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatalf("gzip reader: %v", err)
+	}
+	if buf, err := io.ReadAll(gzr); err != nil || !strings.Contains(string(buf), "sherpa.init") {
+		t.Fatalf("reading gzip body: %v", err)
+	}
+
+	if resp := get("/sherpa.js", "deflate, gzip;q=0"); resp.Header().Get("Content-Encoding") != "deflate" {
+		t.Fatalf("sherpa.js: got headers %v, expected deflate", resp.Header())
+	}
+	if resp := get("/sherpa.js", "gzip;q=0, *"); resp.Header().Get("Content-Encoding") != "deflate" {
+		t.Fatalf("sherpa.js: got headers %v, expected deflate for refused gzip with wildcard", resp.Header())
+	}
+	if resp := get("/sherpa.js", "*"); resp.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("sherpa.js: got headers %v, expected gzip for wildcard", resp.Header())
+	}
+	if resp := get("/sherpa.js", ""); resp.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("sherpa.js: got headers %v, expected no compression", resp.Header())
+	}
+	if resp := get("/_docs", "gzip"); resp.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("small response: got headers %v, expected no compression", resp.Header())
+	}
+
+	// Compressed responses are not sniffed for a content type by net/http.
+	h, err = NewHandler("/", "0.0.1", exampleAPI{}, &sherpadoc.Section{}, &HandlerOpts{CompressMinSize: 1})
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+	resp = get("/", "gzip")
+	if resp.Header().Get("Content-Encoding") != "gzip" || resp.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("index: got headers %v, expected gzip html", resp.Header())
+	}
+}
+
+func TestCallInfo(t *testing.T) {
+	h, err := NewHandler("/", "0.0.1", exampleAPI{}, &sherpadoc.Section{}, nil)
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+	req := httptest.NewRequest("POST", "/whoami", strings.NewReader(`{"params": ["mjl"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Test", "test")
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	if body := resp.Body.String(); body != `{"result":"whoami [\"mjl\"] test"}`+"\n" {
+		t.Fatalf("got response %s", body)
+	}
+	if resp.Header().Get("Set-Cookie") != "name=mjl" || !strings.HasPrefix(resp.Header().Get("Content-Type"), "application/json") {
+		t.Fatalf("bad response headers %v", resp.Header())
+	}
+}
@@ -0,0 +1,224 @@
+package sherpa
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrIdempotencyInProgress is returned by IdempotencyStore.Begin when a call with
+// the same key is still in progress.
+var ErrIdempotencyInProgress = errors.New("call with idempotency key in progress")
+
+// IdempotentResponse is a stored response of a successful function call made
+// with an idempotency key.
+type IdempotentResponse struct {
+	Status int         // HTTP status code.
+	Header http.Header // Headers set by the function through CallInfo, nil values for deleted headers.
+	Body   []byte      // JSON response.
+}
+
+// IdempotencyStore stores responses of function calls made with an
+// Idempotency-Key header, see HandlerOpts.IdempotencyStore.
+//
+// Keys passed to the store are composed of the caller identity from
+// HandlerOpts.IdempotencyScope (if set), the function name, the Idempotency-Key
+// header and a hash of the parameters.
+type IdempotencyStore interface {
+	// Begin is called before a call with an idempotency key. If a response was
+	// stored for key, it is returned and the function is not called. If a call with
+	// key is in progress, ErrIdempotencyInProgress must be returned. Otherwise, key
+	// must be marked as in progress, and a nil response returned.
+	Begin(key string) (*IdempotentResponse, error)
+
+	// Finish is called after a call that Begin marked as in progress. If resp is
+	// not nil, the call succeeded and resp must be stored. Otherwise, the mark must
+	// be removed, so the call can be retried.
+	Finish(key string, resp *IdempotentResponse)
+}
+
+// NewMemoryIdempotencyStore returns an IdempotencyStore that keeps responses in
+// memory for duration ttl. Responses are lost when the process restarts, and are
+// not shared between processes.
+func NewMemoryIdempotencyStore(ttl time.Duration) IdempotencyStore {
+	return &memoryIdempotencyStore{ttl: ttl, entries: map[string]*idempotencyEntry{}}
+}
+
+type memoryIdempotencyStore struct {
+	ttl time.Duration
+
+	sync.Mutex
+	entries map[string]*idempotencyEntry
+	cleaned time.Time // Last time expired entries were removed.
+}
+
+type idempotencyEntry struct {
+	resp    *IdempotentResponse // Nil while in progress.
+	expires time.Time
+}
+
+func (s *memoryIdempotencyStore) Begin(key string) (*IdempotentResponse, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.cleaned) > time.Minute {
+		for k, e := range s.entries {
+			if e.resp != nil && now.After(e.expires) {
+				delete(s.entries, k)
+			}
+		}
+		s.cleaned = now
+	}
+
+	e, ok := s.entries[key]
+	switch {
+	case !ok || e.resp != nil && now.After(e.expires):
+		s.entries[key] = &idempotencyEntry{}
+		return nil, nil
+	case e.resp == nil:
+		return nil, ErrIdempotencyInProgress
+	default:
+		return e.resp, nil
+	}
+}
+
+func (s *memoryIdempotencyStore) Finish(key string, resp *IdempotentResponse) {
+	s.Lock()
+	defer s.Unlock()
+	if resp == nil {
+		delete(s.entries, key)
+	} else {
+		s.entries[key] = &idempotencyEntry{resp, time.Now().Add(s.ttl)}
+	}
+}
+
+// recordingWriter passes a response through, keeping a copy of the status and
+// body, and of the headers set by the function through CallInfo.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	header http.Header // Filled through ResponseHeader, nil values for deleted headers.
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(buf []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.body.Write(buf)
+	return w.ResponseWriter.Write(buf)
+}
+
+func (w *recordingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// idempotentCall handles a POST function call with an Idempotency-Key header.
+func (h *handler) idempotentCall(w http.ResponseWriter, r *http.Request, name string, fn *function, idempotencyKey string) {
+	buf, err := io.ReadAll(r.Body)
+	if xerr := bodyTooLarge(err); xerr != nil {
+		h.opts.Collector.ProtocolError()
+		respondJSON(w, http.StatusRequestEntityTooLarge, &response{Error: xerr})
+		return
+	} else if err != nil {
+		h.opts.Collector.ProtocolError()
+		respondJSON(w, 200, &response{Error: &Error{Code: SherpaBadRequest, Message: "reading request body: " + err.Error()}})
+		return
+	}
+
+	sum := sha256.Sum256(buf)
+	key := name + "\n" + idempotencyKey + "\n" + hex.EncodeToString(sum[:])
+	if h.opts.IdempotencyScope != nil {
+		key = h.opts.IdempotencyScope(r) + "\n" + key
+	}
+
+	store := h.opts.IdempotencyStore
+	resp, err := store.Begin(key)
+	if errors.Is(err, ErrIdempotencyInProgress) {
+		respondJSON(w, http.StatusConflict, &response{Error: &Error{Code: SherpaIdempotencyInProgress, Message: fmt.Sprintf("call with idempotency key %q is in progress", idempotencyKey)}})
+		return
+	} else if err != nil {
+		respondJSON(w, 500, &response{Error: &Error{Code: ServerError, Message: "idempotency store: " + err.Error()}})
+		return
+	} else if resp != nil {
+		// Stored responses must not be replayed to callers that cannot call the
+		// function.
+		if se := h.authorizeReplay(r, name, fn, buf); se != nil {
+			respondJSON(w, h.errorStatus(se), &response{Error: se})
+			return
+		}
+		// Only headers set by the function are stored. Others, e.g. for CORS and
+		// compression, are set for this request.
+		for k, v := range resp.Header {
+			if len(v) == 0 {
+				w.Header().Del(k)
+			} else {
+				w.Header()[k] = v
+			}
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(resp.Status)
+		if _, err := w.Write(resp.Body); err != nil && !isConnectionClosed(err) {
+			log.Println("writing stored idempotent response:", err)
+		}
+		return
+	}
+
+	// Only successful non-stream responses are stored, after an error the call can be retried.
+	rw := &recordingWriter{ResponseWriter: w, header: http.Header{}}
+	var stored *IdempotentResponse
+	defer func() {
+		store.Finish(key, stored)
+	}()
+	ok := h.post(rw, r, name, fn, bytes.NewReader(buf))
+	if ok {
+		stored = &IdempotentResponse{rw.status, rw.header, rw.body.Bytes()}
+	}
+}
+
+// authorizeReplay calls HandlerOpts.Authorize before replaying a stored response
+// for a call of function fn with JSON request body buf, like a regular call
+// would. The returned error is registered with the collector.
+func (h *handler) authorizeReplay(r *http.Request, name string, fn *function, buf []byte) *Error {
+	if h.opts.Authorize == nil || fn.policy == PolicyPublic {
+		return nil
+	}
+	t0 := time.Now()
+	var request struct {
+		Params []any `json:"params"`
+	}
+	var se *Error
+	ctx := r.Context()
+	if err := json.Unmarshal(buf, &request); err != nil {
+		se = &Error{Code: SherpaBadRequest, Message: "invalid request body: " + err.Error()}
+	} else {
+		if h.opts.NewContext != nil {
+			ctx = h.opts.NewContext(r, name, request.Params)
+		}
+		se = h.authorize(ctx, r, name, fn)
+	}
+	if se != nil {
+		h.opts.Collector.FunctionCall(name, float64(time.Since(t0))/float64(time.Second), se.Code)
+		if m := callMetrics(r); m != nil {
+			m.ErrorCode = se.Code
+		}
+	}
+	return se
+}
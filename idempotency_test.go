@@ -0,0 +1,165 @@
+package sherpa
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/sherpadoc"
+)
+
+func TestIdempotency(t *testing.T) {
+	collector := &countCollector{}
+	store := NewMemoryIdempotencyStore(time.Minute)
+	h, err := NewHandler("/", "0.0.1", exampleAPI{}, &sherpadoc.Section{}, &HandlerOpts{Collector: collector, IdempotencyStore: store})
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+
+	call := func(path, key, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", key)
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		return resp
+	}
+
+	test := func(path, key, body string, expCalls int, expReplayed bool) {
+		t.Helper()
+		collector.calls = nil
+		resp := call(path, key, body)
+		if len(collector.calls) != expCalls || (resp.Header().Get("Idempotent-Replayed") == "true") != expReplayed {
+			t.Fatalf("%s %s: got %d calls, replayed header %q, expected %d calls, replayed %v", path, body, len(collector.calls), resp.Header().Get("Idempotent-Replayed"), expCalls, expReplayed)
+		}
+	}
+
+	test("/sum", "k1", `{"params": [1, 2]}`, 1, false)
+	test("/sum", "k1", `{"params": [1, 2]}`, 0, true)
+	test("/sum", "k1", `{"params": [2, 2]}`, 1, false)
+	test("/sum", "k2", `{"params": [1, 2]}`, 1, false)
+
+	// Errors are not stored.
+	test("/fail", "k1", `{"params": ["user:x"]}`, 1, false)
+	test("/fail", "k1", `{"params": ["user:x"]}`, 1, false)
+
+	resp := call("/sum", "k1", `{"params": [1, 2]}`)
+	if resp.Body.String() != "{\"result\":3}\n" {
+		t.Fatalf("got stored response %q", resp.Body.String())
+	}
+
+	// Concurrent duplicate calls are rejected.
+	if _, err := store.Begin("x"); err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	if _, err := store.Begin("x"); err != ErrIdempotencyInProgress {
+		t.Fatalf("got error %v for call in progress, expected ErrIdempotencyInProgress", err)
+	}
+	store.Finish("x", nil)
+	if resp, err := store.Begin("x"); resp != nil || err != nil {
+		t.Fatalf("begin after failed call: got %v, %v", resp, err)
+	}
+}
+
+func TestIdempotencyAuthorize(t *testing.T) {
+	var authorized int
+	opts := &HandlerOpts{
+		IdempotencyStore: NewMemoryIdempotencyStore(time.Minute),
+		IdempotencyScope: func(req *http.Request) string { return req.Header.Get("Authorization") },
+		Authorize: func(ctx context.Context, req *http.Request, functionName string, policy Policy) error {
+			authorized++
+			if req.Header.Get("Authorization") == "" {
+				return &Error{Code: UserUnauthorized, Message: "no credentials"}
+			}
+			return nil
+		},
+	}
+	h, err := NewHandler("/", "0.0.1", exampleAPI{}, &sherpadoc.Section{}, opts)
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+
+	call := func(auth string, expStatus int, expReplayed bool) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/sum", strings.NewReader(`{"params": [1, 2]}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", "k1")
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		if resp.Code != expStatus || (resp.Header().Get("Idempotent-Replayed") == "true") != expReplayed {
+			t.Fatalf("authorization %q: got status %d, replayed %q, expected %d, %v", auth, resp.Code, resp.Header().Get("Idempotent-Replayed"), expStatus, expReplayed)
+		}
+	}
+	call("a", 200, false)
+	call("a", 200, true)
+	call("", http.StatusUnauthorized, false)
+	call("b", 200, false) // Other caller does not get the stored response of "a".
+	if authorized != 4 {
+		t.Fatalf("authorize called %d times, expected 4", authorized)
+	}
+
+	// Parameters for NewContext are parsed before replaying. A store that returns a
+	// response for every key gets a replay for a bad body.
+	opts.IdempotencyStore = replayStore{}
+	opts.NewContext = func(req *http.Request, functionName string, params []any) context.Context {
+		return req.Context()
+	}
+	h, err = NewHandler("/", "0.0.1", exampleAPI{}, &sherpadoc.Section{}, opts)
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+	req := httptest.NewRequest("POST", "/sum", strings.NewReader(`{"params": [1, 2]`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", "k1")
+	req.Header.Set("Authorization", "a")
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	if !strings.Contains(resp.Body.String(), SherpaBadRequest) || resp.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("replay with bad body: got %d %q, expected bad request", resp.Code, resp.Body.String())
+	}
+}
+
+type replayStore struct{}
+
+func (replayStore) Begin(key string) (*IdempotentResponse, error) {
+	return &IdempotentResponse{200, nil, []byte(`{"result":3}`)}, nil
+}
+
+func (replayStore) Finish(key string, resp *IdempotentResponse) {}
+
+func TestIdempotencyHeaders(t *testing.T) {
+	opts := &HandlerOpts{
+		IdempotencyStore: NewMemoryIdempotencyStore(time.Minute),
+		CORS:             &CORS{AllowOrigins: []string{"https://a.example", "https://b.example"}},
+	}
+	h, err := NewHandler("/", "0.0.1", exampleAPI{}, &sherpadoc.Section{}, opts)
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+
+	call := func(origin string) http.Header {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/whoami", strings.NewReader(`{"params": ["mjl"]}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", "k1")
+		req.Header.Set("Origin", origin)
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		if resp.Code != 200 {
+			t.Fatalf("got status %d, expected 200", resp.Code)
+		}
+		return resp.Header()
+	}
+	call("https://a.example")
+	hdr := call("https://b.example")
+	if hdr.Get("Idempotent-Replayed") != "true" || hdr.Get("Access-Control-Allow-Origin") != "https://b.example" || hdr.Get("Set-Cookie") != "name=mjl" || len(hdr.Values("Vary")) != 2 || hdr.Get("Content-Type") != "application/json; charset=utf-8" {
+		t.Fatalf("bad headers for replayed response: %v", hdr)
+	}
+}
@@ -0,0 +1,130 @@
+package sherpa
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Limits bound the resources a single function call request can make the server
+// use, see HandlerOpts.Limits and FunctionOpts.Limits. Zero values mean no limit.
+// Calls exceeding a limit fail with error code SherpaTooLarge and HTTP status
+// 413.
+type Limits struct {
+	// Maximum size in bytes of the JSON request body for POST, or of the "body"
+	// query string parameter for GET. For "_batch", the limits of HandlerOpts
+	// apply to the whole request.
+	MaxBodyBytes int64
+
+	// Maximum nesting depth of JSON arrays and objects in the parameters. The
+	// params array itself is at depth 1.
+	MaxDepth int
+
+	// Maximum number of elements in a single JSON array or object in the
+	// parameters, including the params array itself. For "_batch", the limit of
+	// HandlerOpts also applies to the number of calls.
+	MaxElements int
+
+	// Maximum length in bytes of a single JSON string in the parameters, including
+	// object keys.
+	MaxStringLength int
+}
+
+// limits returns the limits for calls to f, with limits set in FunctionOpts
+// replacing those in HandlerOpts.
+func (h *handler) limits(f *function) Limits {
+	l := h.opts.Limits
+	if f == nil || f.limits == nil {
+		return l
+	}
+	fl := *f.limits
+	if fl.MaxBodyBytes != 0 {
+		l.MaxBodyBytes = fl.MaxBodyBytes
+	}
+	if fl.MaxDepth != 0 {
+		l.MaxDepth = fl.MaxDepth
+	}
+	if fl.MaxElements != 0 {
+		l.MaxElements = fl.MaxElements
+	}
+	if fl.MaxStringLength != 0 {
+		l.MaxStringLength = fl.MaxStringLength
+	}
+	return l
+}
+
+// tooLarge returns the error for a request exceeding a limit.
+func tooLarge(format string, args ...any) *Error {
+	return &Error{Code: SherpaTooLarge, Message: fmt.Sprintf(format, args...)}
+}
+
+// bodyTooLarge returns an *Error with code SherpaTooLarge if err is from reading
+// a request body exceeding MaxBodyBytes, and nil otherwise.
+func bodyTooLarge(err error) *Error {
+	var mberr *http.MaxBytesError
+	if errors.As(err, &mberr) {
+		return tooLarge("request body larger than %d bytes", mberr.Limit)
+	}
+	return nil
+}
+
+// check returns an error if the JSON params exceed the depth, element or string
+// limits. Params must be valid JSON.
+func (l Limits) check(params []byte) error {
+	if l.MaxDepth == 0 && l.MaxElements == 0 && l.MaxStringLength == 0 {
+		return nil
+	}
+
+	// Array or object we are in. For objects, each key/value pair counts as one
+	// element.
+	type frame struct {
+		object   bool
+		elements int
+		key      bool // Whether the next token in an object is a key.
+	}
+	var stack []frame
+
+	dec := json.NewDecoder(bytes.NewReader(params))
+	dec.UseNumber()
+	for {
+		t, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if d, ok := t.(json.Delim); ok && (d == ']' || d == '}') {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		if n := len(stack); n > 0 {
+			p := &stack[n-1]
+			if !p.object || p.key {
+				p.elements++
+				if l.MaxElements > 0 && p.elements > l.MaxElements {
+					return tooLarge("more than %d elements in array or object", l.MaxElements)
+				}
+			}
+			if p.object {
+				p.key = !p.key
+			}
+		}
+
+		switch v := t.(type) {
+		case json.Delim:
+			stack = append(stack, frame{object: v == '{', key: true})
+			if l.MaxDepth > 0 && len(stack) > l.MaxDepth {
+				return tooLarge("arrays and objects nested deeper than %d levels", l.MaxDepth)
+			}
+		case string:
+			if l.MaxStringLength > 0 && len(v) > l.MaxStringLength {
+				return tooLarge("string longer than %d bytes", l.MaxStringLength)
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package sherpa
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// Methods determines the HTTP methods a function can be called with. Calling with
+// POST is always allowed. Calls with GET have the parameters in the query string,
+// which may end up in logs and browser history, and can be triggered by other
+// web sites, e.g. through an image or script tag.
+//
+// Methods can be set for the root section with HandlerOpts.Methods, for a section
+// with a struct tag on the section field in its parent section, e.g.
+// `sherpa:"methods=get"`, and for a function with HandlerOpts.Functions.
+// Functions inherit the methods of their section, and sections inherit the
+// methods of their parent section. If not set, functions that take parameters
+// (not counting a context.Context) can only be called with POST, and functions
+// without parameters, e.g. for health checks, with MethodsJSONP.
+//
+// The methods of each function are published in sherpa.json.
+type Methods string
+
+const (
+	// MethodsPOST only allows calls with POST.
+	MethodsPOST Methods = "post"
+
+	// MethodsGET allows calls with POST and GET.
+	MethodsGET Methods = "get"
+
+	// MethodsJSONP allows calls with POST and GET, including GET with a "callback"
+	// query string parameter for JSONP.
+	MethodsJSONP Methods = "jsonp"
+)
+
+func (m Methods) valid() error {
+	switch m {
+	case "", MethodsPOST, MethodsGET, MethodsJSONP:
+		return nil
+	}
+	return fmt.Errorf("unknown methods %q", m)
+}
+
+// defaultMethods returns the methods for function fn without explicitly
+// configured methods.
+func defaultMethods(fn reflect.Value) Methods {
+	fnt := fn.Type()
+	n := fnt.NumIn()
+	if n > 0 && fnt.In(0).Implements(reflect.TypeOf((*context.Context)(nil)).Elem()) {
+		n--
+	}
+	if n > 0 {
+		return MethodsPOST
+	}
+	return MethodsJSONP
+}
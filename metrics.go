@@ -0,0 +1,142 @@
+package sherpa
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// ContextCollector is an extended Collector with details about each function
+// call. If HandlerOpts.Collector implements ContextCollector, CallStart and
+// CallDone are called for each POST and GET request for a function, in addition
+// to the Collector methods.
+type ContextCollector interface {
+	Collector
+
+	// CallStart is called when a request for a function is received, before the
+	// request is parsed. Only fields Context, Function, Transport and InFlight are
+	// set.
+	CallStart(m CallMetrics)
+
+	// CallDone is called after the response has been written, for streams after
+	// the stream has ended.
+	CallDone(m CallMetrics)
+}
+
+// CallMetrics describes a function call for a ContextCollector.
+type CallMetrics struct {
+	// Context of the call, from HandlerOpts.NewContext, e.g. for linking metrics to
+	// traces. The context of the HTTP request if the call did not get that far, e.g.
+	// because of a protocol error.
+	Context context.Context
+
+	// Name of the function. For batch requests, "_batch", a single call is reported
+	// for the batch.
+	Function string
+
+	// "POST", "GET" or "JSONP", the latter for GET requests with a callback.
+	Transport string
+
+	// Size of the request body for POST, of the query string for GET and JSONP.
+	RequestSize int64
+
+	// Size of the response body.
+	ResponseSize int64
+
+	// HTTP status code of the response.
+	Status int
+
+	// Error code of a failed call, empty on success and for protocol errors such as
+	// a bad content-type, which are sent with a SherpaBadRequest error.
+	ErrorCode string
+
+	// Time from receiving the request until the response was written.
+	Duration time.Duration
+
+	// Number of function calls in progress. For CallStart including this call, for
+	// CallDone excluding this call.
+	InFlight int
+}
+
+type metricsKey struct{}
+
+// callMetrics returns the metrics for the request, or nil if no ContextCollector
+// is configured.
+func callMetrics(r *http.Request) *CallMetrics {
+	m, _ := r.Context().Value(metricsKey{}).(*CallMetrics)
+	return m
+}
+
+// startMetrics starts collecting metrics for a function call. It returns a
+// response writer and request that must be used for handling the call, and a
+// function that must be called when the call is done.
+func (h *handler) startMetrics(cc ContextCollector, w http.ResponseWriter, r *http.Request, functionName string) (http.ResponseWriter, *http.Request, func()) {
+	t0 := time.Now()
+	m := &CallMetrics{Context: r.Context(), Function: functionName, Transport: r.Method}
+	r = r.WithContext(context.WithValue(r.Context(), metricsKey{}, m))
+	body := &countingReader{r: r.Body}
+	r.Body = body
+	cw := &countingWriter{ResponseWriter: w}
+
+	m.InFlight = int(h.inFlight.Add(1))
+	cc.CallStart(*m)
+
+	return cw, r, func() {
+		m.InFlight = int(h.inFlight.Add(-1))
+		m.Duration = time.Since(t0)
+		m.RequestSize = body.n
+		if r.Method == "GET" {
+			m.RequestSize = int64(len(r.URL.RawQuery))
+		}
+		m.ResponseSize = cw.n
+		m.Status = cw.status
+		if m.Status == 0 {
+			m.Status = http.StatusOK
+		}
+		cc.CallDone(*m)
+	}
+}
+
+type countingReader struct {
+	r io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(buf []byte) (int, error) {
+	n, err := r.r.Read(buf)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *countingReader) Close() error {
+	return r.r.Close()
+}
+
+// countingWriter passes a response through, keeping track of the status and the
+// size of the body.
+type countingWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (w *countingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingWriter) Write(buf []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(buf)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *countingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
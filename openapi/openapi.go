@@ -0,0 +1,452 @@
+// Package openapi converts sherpadoc documentation of a sherpa API to an OpenAPI
+// 3.1 document.
+//
+// Each sherpa function becomes a POST operation at path "/<function>", with a
+// request body {"params": [...]} and a response body {"result": ..., "error":
+// ...}. Structs, Ints and Strings become schemas in the components. Errors are
+// returned with HTTP status 200, except for errors about authorization (401,
+// 403), idempotency keys (409), limits (413) and server failures (500). Calls
+// with GET, for functions that allow them, are not described: they have the
+// request body in query string parameter "body", and fail with HTTP status 405
+// for functions that do not allow GET.
+package openapi
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/mjl-/sherpadoc"
+)
+
+// Version is the OpenAPI version of documents generated by Convert.
+const Version = "3.1.0"
+
+// Document is an OpenAPI document. Only the parts needed for sherpa APIs are
+// included.
+type Document struct {
+	OpenAPI    string               `json:"openapi"`
+	Info       Info                 `json:"info"`
+	Servers    []Server             `json:"servers,omitempty"`
+	Paths      map[string]*PathItem `json:"paths"`
+	Components Components           `json:"components"`
+}
+
+// Info describes the API.
+type Info struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+// Server is a base URL for the API.
+type Server struct {
+	URL string `json:"url"`
+}
+
+// PathItem holds the operations for a path. Sherpa functions are only called
+// with POST.
+type PathItem struct {
+	Post *Operation `json:"post,omitempty"`
+}
+
+// Operation is a sherpa function call.
+type Operation struct {
+	OperationID string              `json:"operationId"`
+	Summary     string              `json:"summary,omitempty"`
+	Description string              `json:"description,omitempty"`
+	Tags        []string            `json:"tags,omitempty"`
+	RequestBody *RequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]Response `json:"responses"`
+
+	// Error codes declared for the function, see Opts.Errors.
+	SherpaErrors []string `json:"x-sherpa-errors,omitempty"`
+}
+
+// RequestBody describes the request body of an operation.
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+// Response describes a response of an operation.
+type Response struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+// MediaType holds the schema for a content type.
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Components holds the named schemas.
+type Components struct {
+	Schemas map[string]*Schema `json:"schemas"`
+}
+
+// Schema is a JSON Schema, as used by OpenAPI 3.1. Only the parts needed for
+// sherpa types are included.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Minimum              *int64             `json:"minimum,omitempty"`
+	Maximum              *uint64            `json:"maximum,omitempty"`
+	Enum                 []any              `json:"enum,omitempty"`
+	EnumNames            []string           `json:"x-enum-varnames,omitempty"`
+	Items                any                `json:"items,omitempty"` // *Schema, or false with PrefixItems.
+	PrefixItems          []*Schema          `json:"prefixItems,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties any                `json:"additionalProperties,omitempty"` // *Schema or bool.
+	AnyOf                []*Schema          `json:"anyOf,omitempty"`
+}
+
+// Opts are options for Convert.
+type Opts struct {
+	// Base URL of the API, e.g. https://www.sherpadoc.org/example/. If not empty, it
+	// is added as server to the document.
+	BaseURL string
+
+	// Error codes declared for functions, keyed by function name, as returned in
+	// sherpa.json and by the "_docs" function. Added to the description of the
+	// operation and as extension "x-sherpa-errors".
+	Errors map[string][]string
+}
+
+// ErrorSchema is the name of the schema for sherpa errors in the components.
+// It contains a dot, so it cannot collide with names of sherpadoc types, which
+// are Go identifiers.
+const ErrorSchema = "sherpa.Error"
+
+// errorResponse returns a response with an error for a non-200 HTTP status.
+func errorResponse(description string) Response {
+	return Response{
+		Description: description,
+		Content: map[string]MediaType{
+			"application/json": {
+				Schema: &Schema{
+					Type:       "object",
+					Properties: map[string]*Schema{"error": {Ref: "#/components/schemas/" + ErrorSchema}},
+					Required:   []string{"error"},
+				},
+			},
+		},
+	}
+}
+
+// Convert returns an OpenAPI document for the API documented by doc.
+//
+// All fields of structs are marked as required: Go always includes them in
+// JSON output, even though they may be absent in JSON input. An error is
+// returned for references to undefined types and duplicate type names.
+func Convert(doc *sherpadoc.Section, opts Opts) (*Document, error) {
+	d := &Document{
+		OpenAPI: Version,
+		Info: Info{
+			Title:       doc.Name,
+			Description: doc.Docs,
+			Version:     doc.Version,
+		},
+		Paths: map[string]*PathItem{},
+		Components: Components{
+			Schemas: map[string]*Schema{
+				ErrorSchema: {
+					Type:        "object",
+					Description: "Error returned by a sherpa function. Code is optional, it can be used to handle errors programmatically. Details is optional structured information about the error.",
+					Properties: map[string]*Schema{
+						"code":    {Type: "string"},
+						"message": {Type: "string"},
+						"details": {},
+					},
+					Required: []string{"code", "message"},
+				},
+			},
+		},
+	}
+	if d.Info.Version == "" {
+		d.Info.Version = "0.0.0"
+	}
+	if opts.BaseURL != "" {
+		d.Servers = []Server{{opts.BaseURL}}
+	}
+
+	c := &converter{d, opts, map[string]bool{}}
+	if err := c.gatherTypes(doc); err != nil {
+		return nil, err
+	}
+	if err := c.section(doc); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+type converter struct {
+	doc   *Document
+	opts  Opts
+	types map[string]bool
+}
+
+func (c *converter) gatherTypes(sec *sherpadoc.Section) error {
+	add := func(name string) error {
+		if c.types[name] {
+			return fmt.Errorf("duplicate type %q", name)
+		}
+		c.types[name] = true
+		return nil
+	}
+	for _, t := range sec.Structs {
+		if err := add(t.Name); err != nil {
+			return err
+		}
+	}
+	for _, t := range sec.Ints {
+		if err := add(t.Name); err != nil {
+			return err
+		}
+	}
+	for _, t := range sec.Strings {
+		if err := add(t.Name); err != nil {
+			return err
+		}
+	}
+	for _, subsec := range sec.Sections {
+		if err := c.gatherTypes(subsec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *converter) section(sec *sherpadoc.Section) error {
+	for _, fn := range sec.Functions {
+		op, err := c.function(sec, fn)
+		if err != nil {
+			return fmt.Errorf("function %s: %v", fn.Name, err)
+		}
+		c.doc.Paths["/"+fn.Name] = &PathItem{Post: op}
+	}
+
+	schemas := c.doc.Components.Schemas
+	for _, t := range sec.Structs {
+		s := &Schema{
+			Type:                 "object",
+			Description:          t.Docs,
+			Properties:           map[string]*Schema{},
+			Required:             []string{},
+			AdditionalProperties: false,
+		}
+		for _, f := range t.Fields {
+			fs, err := c.schema(f.Typewords)
+			if err != nil {
+				return fmt.Errorf("struct %s, field %s: %v", t.Name, f.Name, err)
+			}
+			if f.Docs != "" && fs.Ref == "" {
+				fs.Description = f.Docs
+			}
+			s.Properties[f.Name] = fs
+			s.Required = append(s.Required, f.Name)
+		}
+		schemas[t.Name] = s
+	}
+	for _, t := range sec.Ints {
+		s := &Schema{Type: "integer", Description: t.Docs}
+		for _, v := range t.Values {
+			s.Enum = append(s.Enum, v.Value)
+			s.EnumNames = append(s.EnumNames, v.Name)
+		}
+		schemas[t.Name] = s
+	}
+	for _, t := range sec.Strings {
+		s := &Schema{Type: "string", Description: t.Docs}
+		for _, v := range t.Values {
+			s.Enum = append(s.Enum, v.Value)
+			s.EnumNames = append(s.EnumNames, v.Name)
+		}
+		schemas[t.Name] = s
+	}
+
+	for _, subsec := range sec.Sections {
+		if err := c.section(subsec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *converter) function(sec *sherpadoc.Section, fn *sherpadoc.Function) (*Operation, error) {
+	params := make([]*Schema, len(fn.Params))
+	for i, arg := range fn.Params {
+		s, err := c.schema(arg.Typewords)
+		if err != nil {
+			return nil, fmt.Errorf("param %s: %v", arg.Name, err)
+		}
+		if s.Ref == "" {
+			s.Description = arg.Name
+		}
+		params[i] = s
+	}
+	n := len(params)
+	paramsSchema := &Schema{Type: "array", MinItems: &n, MaxItems: &n}
+	if n > 0 {
+		paramsSchema.PrefixItems = params
+		paramsSchema.Items = false
+	}
+
+	var result *Schema
+	switch len(fn.Returns) {
+	case 0:
+		result = &Schema{Type: "null"}
+	case 1:
+		s, err := c.schema(fn.Returns[0].Typewords)
+		if err != nil {
+			return nil, fmt.Errorf("return %s: %v", fn.Returns[0].Name, err)
+		}
+		result = s
+	default:
+		l := make([]*Schema, len(fn.Returns))
+		for i, arg := range fn.Returns {
+			s, err := c.schema(arg.Typewords)
+			if err != nil {
+				return nil, fmt.Errorf("return %s: %v", arg.Name, err)
+			}
+			l[i] = s
+		}
+		rn := len(l)
+		result = &Schema{Type: "array", PrefixItems: l, Items: false, MinItems: &rn, MaxItems: &rn}
+	}
+
+	summary, _, _ := strings.Cut(fn.Docs, "\n")
+	op := &Operation{
+		OperationID: fn.Name,
+		Summary:     summary,
+		Description: fn.Docs,
+		RequestBody: &RequestBody{
+			Required: true,
+			Content: map[string]MediaType{
+				"application/json": {
+					Schema: &Schema{
+						Type:                 "object",
+						Properties:           map[string]*Schema{"params": paramsSchema},
+						Required:             []string{"params"},
+						AdditionalProperties: false,
+					},
+				},
+			},
+		},
+		Responses: map[string]Response{
+			"200": {
+				Description: "Result of the function call, or an error.",
+				Content: map[string]MediaType{
+					"application/json": {
+						Schema: &Schema{
+							Type: "object",
+							Properties: map[string]*Schema{
+								"result": result,
+								"error":  {Ref: "#/components/schemas/" + ErrorSchema},
+							},
+						},
+					},
+				},
+			},
+			"401": errorResponse("Caller is not authenticated, error code user:unauthorized."),
+			"403": errorResponse("Caller is not authorized, error code user:forbidden, or missing CSRF token, error code sherpa:csrf."),
+			"404": {Description: "Function does not exist."},
+			"409": errorResponse("Call with the same idempotency key is in progress, error code sherpa:idempotencyInProgress."),
+			"413": errorResponse("Request exceeds a limit, error code sherpa:tooLarge."),
+			"500": errorResponse("Internal server error, e.g. error code server:panic."),
+		},
+	}
+	if sec.Name != "" {
+		op.Tags = []string{sec.Name}
+	}
+	if codes := c.opts.Errors[fn.Name]; len(codes) > 0 {
+		op.SherpaErrors = codes
+		if op.Description != "" {
+			op.Description += "\n\n"
+		}
+		op.Description += "Errors: " + strings.Join(codes, ", ")
+	}
+	return op, nil
+}
+
+// schema returns a schema for typewords.
+func (c *converter) schema(typewords []string) (*Schema, error) {
+	if len(typewords) == 0 {
+		return nil, fmt.Errorf("missing type")
+	}
+	t, rest := typewords[0], typewords[1:]
+
+	intRange := func(min int64, max uint64) *Schema {
+		return &Schema{Type: "integer", Minimum: &min, Maximum: &max}
+	}
+
+	var s *Schema
+	switch t {
+	case "nullable":
+		ns, err := c.schema(rest)
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{AnyOf: []*Schema{ns, {Type: "null"}}}, nil
+	case "any":
+		s = &Schema{}
+	case "bool":
+		s = &Schema{Type: "boolean"}
+	case "int8":
+		s = intRange(math.MinInt8, math.MaxInt8)
+	case "uint8":
+		s = intRange(0, math.MaxUint8)
+	case "int16":
+		s = intRange(math.MinInt16, math.MaxInt16)
+	case "uint16":
+		s = intRange(0, math.MaxUint16)
+	case "int32":
+		s = &Schema{Type: "integer", Format: "int32"}
+	case "uint32":
+		s = intRange(0, math.MaxUint32)
+	case "int64":
+		s = &Schema{Type: "integer", Format: "int64"}
+	case "uint64":
+		// No format, "int64" would not allow values above math.MaxInt64.
+		s = intRange(0, math.MaxUint64)
+	case "int64s":
+		s = &Schema{Type: "string", Pattern: "^-?[0-9]+$", Description: "int64 as string"}
+	case "uint64s":
+		s = &Schema{Type: "string", Pattern: "^[0-9]+$", Description: "uint64 as string"}
+	case "float32":
+		s = &Schema{Type: "number", Format: "float"}
+	case "float64":
+		s = &Schema{Type: "number", Format: "double"}
+	case "string":
+		s = &Schema{Type: "string"}
+	case "timestamp":
+		s = &Schema{Type: "string", Format: "date-time"}
+	case "[]":
+		es, err := c.schema(rest)
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{Type: "array", Items: es}, nil
+	case "{}":
+		es, err := c.schema(rest)
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{Type: "object", AdditionalProperties: es}, nil
+	default:
+		if !c.types[t] {
+			return nil, fmt.Errorf("undefined type %q", t)
+		}
+		s = &Schema{Ref: "#/components/schemas/" + t}
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("unexpected words after %q: %v", t, rest)
+	}
+	return s, nil
+}
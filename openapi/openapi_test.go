@@ -0,0 +1,73 @@
+package openapi
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/mjl-/sherpadoc"
+)
+
+func TestConvert(t *testing.T) {
+	doc := &sherpadoc.Section{
+		Name:    "Example",
+		Version: "1.0.0",
+		Functions: []*sherpadoc.Function{
+			{
+				Name:    "get",
+				Docs:    "Get an item.\nMore details.",
+				Params:  []sherpadoc.Arg{{Name: "id", Typewords: []string{"int64s"}}},
+				Returns: []sherpadoc.Arg{{Name: "item", Typewords: []string{"nullable", "Item"}}},
+			},
+		},
+		Structs: []sherpadoc.Struct{
+			{
+				Name: "Item",
+				Fields: []sherpadoc.Field{
+					{Name: "Tags", Typewords: []string{"[]", "string"}},
+					{Name: "Created", Typewords: []string{"timestamp"}},
+					{Name: "Size", Typewords: []string{"uint64"}},
+				},
+			},
+			{Name: "Error"}, // Must not collide with the sherpa error schema.
+		},
+	}
+
+	d, err := Convert(doc, Opts{BaseURL: "http://localhost/example/", Errors: map[string][]string{"get": {"user:notFound"}}})
+	if err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	op := d.Paths["/get"].Post
+	if op == nil || op.Summary != "Get an item." || len(op.SherpaErrors) != 1 {
+		t.Fatalf("bad operation %#v", op)
+	}
+	params := op.RequestBody.Content["application/json"].Schema.Properties["params"]
+	if len(params.PrefixItems) != 1 || params.PrefixItems[0].Type != "string" || *params.MinItems != 1 {
+		t.Fatalf("bad params schema %#v", params)
+	}
+	result := op.Responses["200"].Content["application/json"].Schema.Properties["result"]
+	if len(result.AnyOf) != 2 || result.AnyOf[0].Ref != "#/components/schemas/Item" || result.AnyOf[1].Type != "null" {
+		t.Fatalf("bad result schema %#v", result)
+	}
+	if d.Components.Schemas["Error"] == nil || d.Components.Schemas[ErrorSchema] == nil {
+		t.Fatalf("missing Error or sherpa error schema")
+	}
+	if resp, ok := op.Responses["413"]; !ok || resp.Content["application/json"].Schema.Properties["error"].Ref != "#/components/schemas/"+ErrorSchema {
+		t.Fatalf("bad 413 response %#v", resp)
+	}
+	item := d.Components.Schemas["Item"]
+	if item == nil || item.Properties["Tags"].Type != "array" || item.Properties["Created"].Format != "date-time" {
+		t.Fatalf("bad Item schema %#v", item)
+	}
+	if size := item.Properties["Size"]; size.Format != "" || size.Maximum == nil || *size.Maximum != math.MaxUint64 {
+		t.Fatalf("bad uint64 schema %#v", size)
+	}
+	if _, err := json.Marshal(d); err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	doc.Functions[0].Returns[0].Typewords = []string{"Bogus"}
+	if _, err := Convert(doc, Opts{}); err == nil {
+		t.Fatalf("convert with undefined type succeeded")
+	}
+}
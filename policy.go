@@ -0,0 +1,72 @@
+package sherpa
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Policy is an authorization policy for a function, passed to
+// HandlerOpts.Authorize. The handler only interprets PolicyPublic, other policies
+// are for the Authorize function to enforce.
+//
+// Policies can be set for the root section with HandlerOpts.Policy, for a
+// section with a struct tag on the section field in its parent section, e.g.
+// `sherpa:"policy=authenticated"`, and for a function with
+// HandlerOpts.Functions. Functions inherit the policy of their section, and
+// sections inherit the policy of their parent section.
+type Policy string
+
+const (
+	// PolicyPublic allows anyone to call a function, Authorize is not called.
+	PolicyPublic Policy = "public"
+
+	// PolicyAuthenticated is for functions that can only be called by authenticated users.
+	PolicyAuthenticated Policy = "authenticated"
+)
+
+// PolicyRole returns a policy for functions that can only be called by users with
+// the given role. In a struct tag, use e.g. `sherpa:"policy=role:admin"`.
+func PolicyRole(role string) Policy {
+	return Policy("role:" + role)
+}
+
+// Role returns the role of a policy made with PolicyRole, or the empty string.
+func (p Policy) Role() string {
+	if s, ok := strings.CutPrefix(string(p), "role:"); ok {
+		return s
+	}
+	return ""
+}
+
+// sectionOpts are options for a section, from the "sherpa" struct tag of the
+// field of the section in its parent section.
+type sectionOpts struct {
+	policy  Policy
+	methods Methods
+}
+
+// parseSectionTag parses a "sherpa" struct tag with comma-separated key=value pairs
+// into opts, which starts out with the options inherited from the parent section.
+func parseSectionTag(tag string, opts sectionOpts) (sectionOpts, error) {
+	if tag == "" {
+		return opts, nil
+	}
+	for _, kv := range strings.Split(tag, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return opts, fmt.Errorf("invalid sherpa struct tag element %q, expected key=value", kv)
+		}
+		switch k {
+		case "policy":
+			opts.policy = Policy(v)
+		case "methods":
+			opts.methods = Methods(v)
+			if err := opts.methods.valid(); err != nil {
+				return opts, err
+			}
+		default:
+			return opts, fmt.Errorf("unknown key %q in sherpa struct tag", k)
+		}
+	}
+	return opts, nil
+}
@@ -68,14 +68,43 @@ function thenable(fn) {
 	return nfn;
 }
 
-function postJSON(url, param, success, error) {
+// add the csrf token header to req if the api requires it. the token is read
+// from the csrf cookie if the api has one, any value is accepted otherwise.
+function setCSRF(req, _sherpa) {
+	var csrf = _sherpa.csrf;
+	if(!csrf) {
+		return;
+	}
+	var token = 'sherpa';
+	if(csrf.cookie) {
+		token = '';
+		var cookies = document.cookie.split(';');
+		for(var i = 0; i < cookies.length; i++) {
+			var c = cookies[i].replace(/^\s+/, '');
+			if(c.indexOf(csrf.cookie+'=') === 0) {
+				token = decodeURIComponent(c.substring(csrf.cookie.length+1));
+				break;
+			}
+		}
+	}
+	req.setRequestHeader(csrf.header, token);
+}
+
+function postJSON(_sherpa, url, param, success, error) {
 	var req = new window.XMLHttpRequest();
 	req.open('POST', url, true);
 	req.onload = function onload() {
 		if(req.status >= 200 && req.status < 400) {
 			success(JSON.parse(req.responseText));
 		} else {
-			if(req.status === 404) {
+			var response = null;
+			try {
+				response = JSON.parse(req.responseText);
+			} catch(e) {
+			}
+			if(response && response.error) {
+				error(response.error);
+			} else if(req.status === 404) {
 				error({code: 'sherpaBadFunction', message: 'function does not exist'});
 			} else {
 				error({code: 'sherpaHttpError', message: 'error calling function, HTTP status: '+req.status});
@@ -86,23 +115,100 @@ function postJSON(url, param, success, error) {
 		error({code: 'sherpaClientError', message: 'connection failed'});
 	};
 	req.setRequestHeader('Content-Type', 'application/json');
+	setCSRF(req, _sherpa);
 	req.send(JSON.stringify(param));
 }
 
+// call a function that returns a stream. onResult is called for each result as it
+// comes in. the request asks for newline-delimited JSON, which we parse as it
+// arrives.
+function streamJSON(_sherpa, url, param, onResult, success, error) {
+	var req = new window.XMLHttpRequest();
+	var offset = 0;
+	var done = false;
+	function parse(final) {
+		var text = req.responseText;
+		var nl;
+		while(!done && (nl = text.indexOf('\n', offset)) >= 0) {
+			var line = text.substring(offset, nl);
+			offset = nl+1;
+			var msg;
+			try {
+				msg = JSON.parse(line);
+			} catch(e) {
+				done = true;
+				error({code: 'sherpaBadResponse', message: 'invalid JSON in stream: '+e.message});
+				return;
+			}
+			if(msg.end) {
+				done = true;
+				if(msg.error) {
+					error(msg.error);
+				} else {
+					success();
+				}
+				return;
+			}
+			onResult(msg.result);
+		}
+		if(final && !done) {
+			done = true;
+			error({code: 'sherpaBadResponse', message: 'stream ended without end message'});
+		}
+	}
+	req.open('POST', url, true);
+	req.onprogress = function onprogress() {
+		if(req.status === 200 && (req.getResponseHeader('Content-Type') || '').indexOf('application/x-ndjson') === 0) {
+			parse(false);
+		}
+	};
+	req.onload = function onload() {
+		if(req.status === 200 && (req.getResponseHeader('Content-Type') || '').indexOf('application/x-ndjson') === 0) {
+			parse(true);
+		} else if(req.status >= 200 && req.status < 400) {
+			// regular response, e.g. an error before the stream started.
+			var response = JSON.parse(req.responseText);
+			if(response && response.error) {
+				error(response.error);
+			} else {
+				onResult(response.result);
+				success();
+			}
+		} else if(req.status === 404) {
+			error({code: 'sherpaBadFunction', message: 'function does not exist'});
+		} else {
+			error({code: 'sherpaHttpError', message: 'error calling function, HTTP status: '+req.status});
+		}
+	};
+	req.onerror = function onerror() {
+		error({code: 'sherpaClientError', message: 'connection failed'});
+	};
+	req.setRequestHeader('Content-Type', 'application/json');
+	req.setRequestHeader('Accept', 'application/x-ndjson');
+	setCSRF(req, _sherpa);
+	req.send(JSON.stringify(param));
+}
+
+// functions are always called with POST, which is allowed for all functions, see
+// _sherpa.methods.
+function callFunction(api, name, params) {
+	return api._wrapThenable(thenable(function(resolve, reject) {
+		postJSON(api._sherpa, api._sherpa.baseurl+name, {params: params}, function(response) {
+			if(response && response.error) {
+				reject(response.error);
+			} else if(response && response.hasOwnProperty('result')) {
+				resolve(response.result);
+			} else {
+				reject({code: 'sherpaBadResponse', message: "invalid sherpa response object, missing 'result'"});
+			}
+		}, reject);
+	}));
+}
+
 function makeFunction(api, name) {
 	return function() {
 		var params = Array.prototype.slice.call(arguments, 0);
-		return api._wrapThenable(thenable(function(resolve, reject) {
-			postJSON(api._sherpa.baseurl+name, {params: params}, function(response) {
-				if(response && response.error) {
-					reject(response.error);
-				} else if(response && response.hasOwnProperty('result')) {
-					resolve(response.result);
-				} else {
-					reject({code: 'sherpaBadResponse', message: "invalid sherpa response object, missing 'result'"});
-				}
-			}, reject);
-		}));
+		return callFunction(api, name, params);
 	};
 }
 
@@ -117,9 +223,27 @@ sherpa.init = function init(_sherpa) {
 		return makeFunction(api, name).apply(Array.prototype.slice.call(arguments, 1));
 	}
 
+	// call multiple functions in a single request. calls is a list of objects with
+	// fields "function" and "params". the result is a list with for each call an
+	// object with either a "result" or an "error" field.
+	function _batch(calls) {
+		return callFunction(api, '_batch', [calls]);
+	}
+
+	// call function "name" that returns a stream of results. onResult is called
+	// for each result. the returned thenable resolves when the stream has ended,
+	// or is rejected with the error that ended the stream.
+	function _stream(name, params, onResult) {
+		return api._wrapThenable(thenable(function(resolve, reject) {
+			streamJSON(api._sherpa, api._sherpa.baseurl+name, {params: params}, onResult, resolve, reject);
+		}));
+	}
+
 	api._sherpa = _sherpa;
 	api._wrapThenable = _wrapThenable;
 	api._call = _call;
+	api._batch = _batch;
+	api._stream = _stream;
 	for(var i = 0; i < _sherpa.functions.length; i++) {
 		var fn = _sherpa.functions[i];
 		api[fn] = makeFunction(api, fn);
@@ -0,0 +1,207 @@
+package sherpa
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// stream is a streaming result of a function call: a receive channel, an
+// iter.Seq, or an iter.Seq2 with an error as second value.
+type stream struct {
+	functionName string
+	v            reflect.Value
+	t0           time.Time
+	span         *traceSpan // Nil without HandlerOpts.Tracer.
+}
+
+// streamEnd is the last message of a stream. Error is set if the stream failed.
+type streamEnd struct {
+	End   bool   `json:"end"`
+	Error *Error `json:"error,omitempty"`
+}
+
+// makeStream returns a stream for result v if it is a stream, and nil otherwise.
+func makeStream(functionName string, v interface{}, t0 time.Time) *stream {
+	if v == nil {
+		return nil
+	}
+	rv := reflect.ValueOf(v)
+	if !isStreamType(rv.Type()) {
+		return nil
+	}
+	return &stream{functionName: functionName, v: rv, t0: t0}
+}
+
+// isStreamType returns whether t is a stream type: a receive channel, an
+// iter.Seq, or an iter.Seq2 with an error as second value.
+func isStreamType(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Chan:
+		return t.ChanDir()&reflect.RecvDir != 0
+	case reflect.Func:
+		// iter.Seq[T] is a func(yield func(T) bool), iter.Seq2[T, error] is a
+		// func(yield func(T, error) bool).
+		if t.NumIn() != 1 || t.NumOut() != 0 {
+			return false
+		}
+		yt := t.In(0)
+		if yt.Kind() != reflect.Func || yt.NumOut() != 1 || yt.Out(0).Kind() != reflect.Bool {
+			return false
+		}
+		return yt.NumIn() == 1 || yt.NumIn() == 2 && yt.In(1) == reflect.TypeOf((*error)(nil)).Elem()
+	}
+	return false
+}
+
+// returnsStream returns whether function type fnt returns a stream, as its only
+// return value besides an error.
+func returnsStream(fnt reflect.Type) bool {
+	n := fnt.NumOut()
+	if n > 0 && fnt.Out(n-1) == reflect.TypeOf((*error)(nil)).Elem() {
+		n--
+	}
+	return n == 1 && isStreamType(fnt.Out(0))
+}
+
+// respondStream writes the elements of stream s as they become available. As
+// newline-delimited JSON if the client accepts "application/x-ndjson", and as
+// server-sent events otherwise. Each element is sent as an object with field
+// "result". The last message is an object with field "end" set to true, and field
+// "error" set if the stream failed. The stream is stopped when the request context
+// is canceled.
+func (h *handler) respondStream(w http.ResponseWriter, r *http.Request, s *stream) {
+	ndjson := strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	}
+	w.WriteHeader(200)
+	rc := http.NewResponseController(w)
+
+	write := func(v interface{}) error {
+		buf, err := json.Marshal(v)
+		if err != nil {
+			return &Error{Code: ServerError, Message: fmt.Sprintf("encoding result: %s", err)}
+		}
+		if ndjson {
+			buf = append(buf, '\n')
+		} else {
+			buf = append(append([]byte("data: "), buf...), "\n\n"...)
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		rc.Flush()
+		return nil
+	}
+
+	xerr := h.streamElements(r, s, func(v reflect.Value) error {
+		return write(&response{Result: v.Interface()})
+	})
+
+	var code string
+	switch err := xerr.(type) {
+	case nil:
+		xerr = write(streamEnd{End: true})
+	case *Error:
+		code = err.Code
+		xerr = write(streamEnd{End: true, Error: err})
+	case *InternalServerError:
+		code = err.Code
+		xerr = write(streamEnd{End: true, Error: err.error()})
+	}
+	if xerr != nil && r.Context().Err() == nil && !isConnectionClosed(xerr) {
+		log.Println("writing stream response:", xerr)
+	}
+	h.streamDone(r, s, code)
+}
+
+// streamDone registers the end of stream s with the collector and tracer, with
+// error code set if the stream failed.
+func (h *handler) streamDone(r *http.Request, s *stream, code string) {
+	durationSec := float64(time.Since(s.t0)) / float64(time.Second)
+	h.opts.Collector.FunctionCall(s.functionName, durationSec, code)
+	if m := callMetrics(r); m != nil && m.Function == s.functionName {
+		m.ErrorCode = code
+	}
+	if s.span != nil {
+		// The function duration includes reading the stream.
+		s.span.functionEnd = time.Time{}
+		s.span.end(code)
+	}
+}
+
+// streamElements calls fn for each element of stream s, until the stream is done,
+// the request context is canceled, or fn returns an error. Errors from an
+// iter.Seq2 and panics with *Error or *InternalServerError are returned, as are
+// other panics if HandlerOpts.RecoverPanics is set.
+func (h *handler) streamElements(r *http.Request, s *stream, fn func(v reflect.Value) error) (ee error) {
+	ctx := r.Context()
+
+	defer func() {
+		e := recover()
+		if e == nil {
+			// Nothing
+		} else if se, ok := e.(*Error); ok {
+			ee = se
+		} else if ierr, ok := e.(*InternalServerError); ok {
+			ee = ierr
+		} else if err, ok := e.(error); ok && wrapsSherpaError(err) {
+			ee = h.sherpaError(err)
+		} else if h.opts.RecoverPanics {
+			ee = h.recovered(ctx, r, s.functionName, e)
+		} else {
+			panic(e)
+		}
+	}()
+
+	switch s.v.Kind() {
+	case reflect.Chan:
+		cases := []reflect.SelectCase{
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+			{Dir: reflect.SelectRecv, Chan: s.v},
+		}
+		for {
+			chosen, v, ok := reflect.Select(cases)
+			if chosen == 0 || !ok {
+				return nil
+			}
+			if err := fn(v); err != nil {
+				return err
+			}
+		}
+
+	default:
+		var err error
+		if s.v.Type().In(0).NumIn() == 1 {
+			for v := range s.v.Seq() {
+				if ctx.Err() != nil {
+					break
+				}
+				if err = fn(v); err != nil {
+					break
+				}
+			}
+		} else {
+			for v, verr := range s.v.Seq2() {
+				if ctx.Err() != nil {
+					break
+				}
+				if !verr.IsNil() {
+					err = h.sherpaError(verr.Interface().(error))
+					break
+				}
+				if err = fn(v); err != nil {
+					break
+				}
+			}
+		}
+		return err
+	}
+}
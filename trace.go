@@ -0,0 +1,150 @@
+package sherpa
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TraceContext is a W3C trace context, as sent in the "traceparent" and
+// "tracestate" HTTP headers. See https://www.w3.org/TR/trace-context/.
+//
+// For function calls with a valid traceparent header, the trace context is added
+// to the context of the call, see TraceContextFrom. Package client sends the trace
+// context of the context of a call in its request headers, propagating the trace
+// to other APIs. Without HandlerOpts.Tracer, the trace context of the call is
+// that of the caller, with SpanID of the caller's span.
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte // ID of the span of the caller, the parent span.
+	Flags   byte    // Bit 0 is the "sampled" flag.
+	State   string  // Vendor-specific trace state, from the tracestate header, as is.
+}
+
+// TraceIDString returns the trace ID as lower case hexadecimal string.
+func (tc TraceContext) TraceIDString() string {
+	return hex.EncodeToString(tc.TraceID[:])
+}
+
+// SpanIDString returns the span ID as lower case hexadecimal string.
+func (tc TraceContext) SpanIDString() string {
+	return hex.EncodeToString(tc.SpanID[:])
+}
+
+// Sampled returns whether the sampled flag is set.
+func (tc TraceContext) Sampled() bool {
+	return tc.Flags&1 != 0
+}
+
+// TraceParent returns the value for a traceparent header, in version 00 format.
+func (tc TraceContext) TraceParent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", tc.TraceIDString(), tc.SpanIDString(), tc.Flags)
+}
+
+// ParseTraceParent parses the value of a traceparent header. The trace state is
+// left empty.
+func ParseTraceParent(s string) (TraceContext, error) {
+	var tc TraceContext
+	// Version 00 is exactly 55 characters. Later versions may add fields, after a dash.
+	if len(s) < 55 || len(s) > 55 && (s[:2] == "00" || s[55] != '-') {
+		return tc, fmt.Errorf("bad traceparent length")
+	}
+	t := strings.Split(s[:55], "-")
+	if len(t) != 4 || len(t[0]) != 2 || len(t[1]) != 32 || len(t[2]) != 16 || len(t[3]) != 2 {
+		return tc, fmt.Errorf("bad traceparent syntax")
+	}
+	var version, flags [1]byte
+	for i, dst := range [][]byte{version[:], tc.TraceID[:], tc.SpanID[:], flags[:]} {
+		if strings.ToLower(t[i]) != t[i] {
+			return tc, fmt.Errorf("traceparent must be lower case")
+		}
+		if _, err := hex.Decode(dst, []byte(t[i])); err != nil {
+			return tc, fmt.Errorf("bad hex in traceparent: %v", err)
+		}
+	}
+	tc.Flags = flags[0]
+	if version[0] == 0xff {
+		return tc, fmt.Errorf("invalid traceparent version ff")
+	} else if tc.TraceID == [16]byte{} {
+		return tc, fmt.Errorf("invalid all-zero trace id")
+	} else if tc.SpanID == [8]byte{} {
+		return tc, fmt.Errorf("invalid all-zero parent id")
+	}
+	return tc, nil
+}
+
+// traceContext returns the trace context from the headers of r, and whether the
+// headers were present and valid.
+func traceContext(r *http.Request) (TraceContext, bool) {
+	tp := r.Header.Get("traceparent")
+	if tp == "" {
+		return TraceContext{}, false
+	}
+	tc, err := ParseTraceParent(tp)
+	if err != nil {
+		return TraceContext{}, false
+	}
+	tc.State = strings.Join(r.Header.Values("tracestate"), ",")
+	return tc, true
+}
+
+type traceKey struct{}
+
+// WithTraceContext returns a context with trace context tc. E.g. for a Tracer to
+// set its span as parent for calls made with package client.
+func WithTraceContext(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceKey{}, tc)
+}
+
+// TraceContextFrom returns the trace context from ctx, and whether it was present.
+func TraceContextFrom(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceKey{}).(TraceContext)
+	return tc, ok
+}
+
+// Tracer starts spans for function calls, see HandlerOpts.Tracer.
+type Tracer interface {
+	// StartSpan is called for each function call, after the request has been
+	// parsed, before authorization and calling the function. Ctx is the context of
+	// the call, with the TraceContext from the request headers if present (also
+	// passed as parent, with ok set). The returned context is used for the call, a
+	// tracer typically adds its span to it, e.g. with WithTraceContext.
+	StartSpan(ctx context.Context, functionName string, parent TraceContext, ok bool) (context.Context, Span)
+}
+
+// Span is a span of a function call, started by a Tracer.
+type Span interface {
+	// End is called when the call is done, with the error code of a failed call
+	// (empty on success), the duration of the function call (including
+	// interceptors), and the total duration since parsing the request, excluding
+	// writing the response. For streams, End is called when the stream has ended,
+	// and the function duration includes reading the stream.
+	End(errorCode string, functionDuration, totalDuration time.Duration)
+}
+
+// traceSpan is a span started by HandlerOpts.Tracer for a function call.
+type traceSpan struct {
+	span                       Span
+	t0                         time.Time // Start of handling the call.
+	functionStart, functionEnd time.Time // Zero if not started or not yet ended.
+}
+
+// end ends the span, if not nil.
+func (s *traceSpan) end(code string) {
+	if s == nil {
+		return
+	}
+	now := time.Now()
+	var fd time.Duration
+	if !s.functionStart.IsZero() {
+		end := s.functionEnd
+		if end.IsZero() {
+			end = now
+		}
+		fd = end.Sub(s.functionStart)
+	}
+	s.span.End(code, fd, now.Sub(s.t0))
+}
@@ -0,0 +1,110 @@
+package sherpa
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/sherpadoc"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	tc, err := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if tc.TraceIDString() != "4bf92f3577b34da6a3ce929d0e0e4736" || tc.SpanIDString() != "00f067aa0ba902b7" || !tc.Sampled() {
+		t.Fatalf("bad trace context %#v", tc)
+	}
+	if s := tc.TraceParent(); s != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Fatalf("got traceparent %q", s)
+	}
+	for _, s := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00_4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		if _, err := ParseTraceParent(s); err == nil {
+			t.Fatalf("parse %q succeeded", s)
+		}
+	}
+	if _, err := ParseTraceParent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"); err != nil {
+		t.Fatalf("parse future version: %v", err)
+	}
+}
+
+type testTracer struct {
+	parent  TraceContext
+	ok      bool
+	started string
+	code    string
+	ended   bool
+}
+
+type testSpan struct {
+	t *testTracer
+}
+
+func (t *testTracer) StartSpan(ctx context.Context, functionName string, parent TraceContext, ok bool) (context.Context, Span) {
+	t.parent, t.ok, t.started = parent, ok, functionName
+	return ctx, testSpan{t}
+}
+
+func (s testSpan) End(errorCode string, functionDuration, totalDuration time.Duration) {
+	s.t.code, s.t.ended = errorCode, functionDuration <= totalDuration
+}
+
+func TestTracer(t *testing.T) {
+	tracer := &testTracer{}
+	h, err := NewHandler("/", "0.0.1", exampleAPI{}, &sherpadoc.Section{}, &HandlerOpts{Tracer: tracer})
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/fail", strings.NewReader(`{"params": ["user:x"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set("tracestate", "vendor=value")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if !tracer.ok || tracer.parent.TraceIDString() != "4bf92f3577b34da6a3ce929d0e0e4736" || tracer.parent.State != "vendor=value" {
+		t.Fatalf("bad parent %v %#v", tracer.ok, tracer.parent)
+	}
+	if tracer.started != "fail" || tracer.code != "user:x" || !tracer.ended {
+		t.Fatalf("bad span, started %q, code %q, ended %v", tracer.started, tracer.code, tracer.ended)
+	}
+
+	*tracer = testTracer{}
+	post(t, h, "/count", `{"params": [2]}`)
+	if tracer.ok || tracer.started != "count" || tracer.code != "" || !tracer.ended {
+		t.Fatalf("bad span for stream, ok %v, started %q, code %q, ended %v", tracer.ok, tracer.started, tracer.code, tracer.ended)
+	}
+}
+
+func TestTraceContextPassThrough(t *testing.T) {
+	// Without Tracer, the trace context from the request is passed through unchanged.
+	var tc TraceContext
+	var ok bool
+	intercept := func(ctx context.Context, req *http.Request, functionName string, params []any, next func(ctx context.Context) (any, error)) (any, error) {
+		tc, ok = TraceContextFrom(ctx)
+		return next(ctx)
+	}
+	h, err := NewHandler("/", "0.0.1", exampleAPI{}, &sherpadoc.Section{}, &HandlerOpts{Interceptors: []Interceptor{intercept}})
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest("POST", "/sum", strings.NewReader(`{"params": [1, 2]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("traceparent", traceparent)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if !ok || tc.TraceParent() != traceparent {
+		t.Fatalf("got trace context %v %#v, expected %s", ok, tc, traceparent)
+	}
+}
@@ -0,0 +1,440 @@
+// Package tsgen generates a TypeScript client module for a sherpa API from its
+// sherpadoc documentation.
+//
+// The module has interfaces for Structs, enums for Ints and Strings, a
+// SherpaError class for errors returned by the API, and a client class with a
+// typed async method for each function. Typewords are mapped to TypeScript types:
+// int64s and uint64s to string, other numeric types to number, timestamp to Date,
+// nullable to a union with null, arrays to T[] and maps to objects with string
+// keys. Timestamps in results are turned into Date objects.
+package tsgen
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/mjl-/sherpadoc"
+)
+
+// Opts are options for Generate.
+type Opts struct {
+	// Name of the generated client class. Defaults to "Client".
+	ClassName string
+
+	// Default base URL for the client, e.g. https://www.sherpadoc.org/example/. If
+	// empty, the base URL must be passed to the constructor.
+	BaseURL string
+
+	// Error codes declared for functions, keyed by function name, as returned in
+	// sherpa.json and by the "_docs" function. Added to the documentation comment
+	// of the methods.
+	Errors map[string][]string
+}
+
+// Generate writes a TypeScript module for the API documented by doc to w.
+//
+// An error is returned for references to undefined types.
+func Generate(w io.Writer, doc *sherpadoc.Section, opts Opts) error {
+	if opts.ClassName == "" {
+		opts.ClassName = "Client"
+	}
+	g := &generator{opts: opts, types: map[string]bool{}}
+	g.gatherTypes(doc)
+
+	g.printf("// Generated by sherpats from sherpadoc documentation for %s, version %s. Do not edit.\n\n", doc.Name, doc.Version)
+	if err := g.typesSection(doc); err != nil {
+		return err
+	}
+	g.runtime(doc)
+
+	g.printf("\n")
+	g.comment("", doc.Docs)
+	g.printf("export class %s {\n", opts.ClassName)
+	if opts.BaseURL != "" {
+		g.printf("\tconstructor(private baseURL: string = %s, private options: ClientOptions = {}) {\n\t}\n", jsString(opts.BaseURL))
+	} else {
+		g.printf("\tconstructor(private baseURL: string, private options: ClientOptions = {}) {\n\t}\n")
+	}
+	if err := g.functions(doc); err != nil {
+		return err
+	}
+	g.printf("}\n")
+
+	if g.err != nil {
+		return g.err
+	}
+	_, err := io.WriteString(w, g.b.String())
+	return err
+}
+
+type generator struct {
+	opts  Opts
+	types map[string]bool
+	b     strings.Builder
+	err   error
+}
+
+func (g *generator) printf(format string, args ...any) {
+	fmt.Fprintf(&g.b, format, args...)
+}
+
+// comment writes text as a doc comment, with each line indented.
+func (g *generator) comment(indent, text string) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return
+	}
+	text = strings.ReplaceAll(text, "*/", "* /")
+	g.printf("%s/**\n", indent)
+	for _, line := range strings.Split(text, "\n") {
+		g.printf("%s * %s\n", indent, strings.TrimRight(line, " \t"))
+	}
+	g.printf("%s */\n", indent)
+}
+
+func (g *generator) gatherTypes(sec *sherpadoc.Section) {
+	for _, t := range sec.Structs {
+		g.types[t.Name] = true
+	}
+	for _, t := range sec.Ints {
+		g.types[t.Name] = true
+	}
+	for _, t := range sec.Strings {
+		g.types[t.Name] = true
+	}
+	for _, subsec := range sec.Sections {
+		g.gatherTypes(subsec)
+	}
+}
+
+func (g *generator) typesSection(sec *sherpadoc.Section) error {
+	for _, t := range sec.Structs {
+		g.comment("", t.Docs)
+		g.printf("export interface %s {\n", t.Name)
+		for _, f := range t.Fields {
+			tt, err := g.tsType(f.Typewords)
+			if err != nil {
+				return fmt.Errorf("struct %s, field %s: %v", t.Name, f.Name, err)
+			}
+			g.comment("\t", f.Docs)
+			g.printf("\t%s: %s\n", f.Name, tt)
+		}
+		g.printf("}\n\n")
+	}
+	for _, t := range sec.Ints {
+		g.comment("", t.Docs)
+		g.printf("export enum %s {\n", t.Name)
+		for _, v := range t.Values {
+			g.comment("\t", v.Docs)
+			g.printf("\t%s = %d,\n", v.Name, v.Value)
+		}
+		g.printf("}\n\n")
+	}
+	for _, t := range sec.Strings {
+		g.comment("", t.Docs)
+		g.printf("export enum %s {\n", t.Name)
+		for _, v := range t.Values {
+			g.comment("\t", v.Docs)
+			g.printf("\t%s = %s,\n", v.Name, jsString(v.Value))
+		}
+		g.printf("}\n\n")
+	}
+	for _, subsec := range sec.Sections {
+		if err := g.typesSection(subsec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *generator) functions(sec *sherpadoc.Section) error {
+	for _, fn := range sec.Functions {
+		var params, names []string
+		for i, arg := range fn.Params {
+			tt, err := g.tsType(arg.Typewords)
+			if err != nil {
+				return fmt.Errorf("function %s, param %s: %v", fn.Name, arg.Name, err)
+			}
+			name := identifier(arg.Name, i)
+			params = append(params, name+": "+tt)
+			names = append(names, name)
+		}
+		var returns []string
+		returnTypes := [][]string{}
+		for _, arg := range fn.Returns {
+			tt, err := g.tsType(arg.Typewords)
+			if err != nil {
+				return fmt.Errorf("function %s, return %s: %v", fn.Name, arg.Name, err)
+			}
+			returns = append(returns, tt)
+			returnTypes = append(returnTypes, arg.Typewords)
+		}
+		var result string
+		switch len(returns) {
+		case 0:
+			result = "void"
+		case 1:
+			result = returns[0]
+		default:
+			result = "[" + strings.Join(returns, ", ") + "]"
+		}
+		rt, err := json.Marshal(returnTypes)
+		if err != nil {
+			return err
+		}
+
+		docs := fn.Docs
+		if codes := g.opts.Errors[fn.Name]; len(codes) > 0 {
+			docs = strings.TrimSpace(docs) + "\n\n@throws {SherpaError} With code " + strings.Join(codes, ", ") + "."
+		}
+		g.printf("\n")
+		g.comment("\t", docs)
+		g.printf("\tasync %s(%s): Promise<%s> {\n", fn.Name, strings.Join(params, ", "), result)
+		g.printf("\t\treturn await _sherpaCall(this.baseURL, this.options, %s, [%s], %s) as %s\n", jsString(fn.Name), strings.Join(names, ", "), rt, result)
+		g.printf("\t}\n")
+	}
+	for _, subsec := range sec.Sections {
+		if err := g.functions(subsec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tsType returns the TypeScript type for typewords.
+func (g *generator) tsType(typewords []string) (string, error) {
+	if len(typewords) == 0 {
+		return "", fmt.Errorf("missing type")
+	}
+	t, rest := typewords[0], typewords[1:]
+	var s string
+	switch t {
+	case "nullable":
+		nt, err := g.tsType(rest)
+		if err != nil {
+			return "", err
+		}
+		return nt + " | null", nil
+	case "[]", "{}":
+		et, err := g.tsType(rest)
+		if err != nil {
+			return "", err
+		}
+		if len(rest) > 0 && rest[0] == "nullable" {
+			et = "(" + et + ")"
+		}
+		if t == "[]" {
+			return et + "[]", nil
+		}
+		return "{ [key: string]: " + et + " }", nil
+	case "any":
+		s = "any"
+	case "bool":
+		s = "boolean"
+	case "int8", "uint8", "int16", "uint16", "int32", "uint32", "int64", "uint64", "float32", "float64":
+		s = "number"
+	case "int64s", "uint64s", "string":
+		s = "string"
+	case "timestamp":
+		s = "Date"
+	default:
+		if !g.types[t] {
+			return "", fmt.Errorf("undefined type %q", t)
+		}
+		s = t
+	}
+	if len(rest) > 0 {
+		return "", fmt.Errorf("unexpected words after %q: %v", t, rest)
+	}
+	return s, nil
+}
+
+// runtime writes the types and functions used by the generated client class.
+func (g *generator) runtime(doc *sherpadoc.Section) {
+	// Fields of structs, for converting timestamps in results to Dates.
+	structs := map[string]map[string][]string{}
+	var gather func(sec *sherpadoc.Section)
+	gather = func(sec *sherpadoc.Section) {
+		for _, t := range sec.Structs {
+			fields := map[string][]string{}
+			for _, f := range t.Fields {
+				fields[f.Name] = f.Typewords
+			}
+			structs[t.Name] = fields
+		}
+		for _, subsec := range sec.Sections {
+			gather(subsec)
+		}
+	}
+	gather(doc)
+	buf, err := json.Marshal(structs)
+	if err != nil && g.err == nil {
+		g.err = err
+	}
+
+	g.printf(`// SherpaError is an error returned by the API, or generated by the client,
+// e.g. for network errors. Code can be used to handle errors programmatically.
+// Details is optional structured information about the error.
+export class SherpaError extends Error {
+	constructor(public code: string, message: string, public details?: any) {
+		super(message)
+		this.name = 'SherpaError'
+	}
+}
+
+// ClientOptions are passed to fetch for each call.
+export interface ClientOptions {
+	headers?: { [name: string]: string }
+	credentials?: RequestCredentials
+	signal?: AbortSignal
+	// CSRF token to send with each call, for APIs that require one, as published
+	// in field "csrf" of sherpa.json. The token is read from the cookie if set,
+	// otherwise any token is accepted. Cookies can only be read by pages with the
+	// origin of the API.
+	csrf?: { header: string, cookie?: string }
+}
+
+// _csrfToken returns the CSRF token to send, read from the cookie if any. If the
+// cookie is not set yet, sherpa.json is requested, which sets it. Pages can only
+// read the cookie if they have the origin of the API, so pages on other origins
+// cannot call APIs that require a CSRF cookie.
+async function _csrfToken(baseURL: string, options: ClientOptions): Promise<string> {
+	const cookie = options.csrf?.cookie
+	if (!cookie) {
+		return 'sherpa'
+	}
+	let token = _cookie(cookie)
+	if (token === undefined) {
+		try {
+			await fetch(baseURL + 'sherpa.json', { credentials: options.credentials, signal: options.signal })
+		} catch (err) {
+			// The call itself will fail and report the error.
+		}
+		token = _cookie(cookie)
+	}
+	return token || ''
+}
+
+function _cookie(name: string): string | undefined {
+	for (const c of document.cookie.split(';')) {
+		const [k, ...v] = c.trim().split('=')
+		if (k === name) {
+			return decodeURIComponent(v.join('='))
+		}
+	}
+	return undefined
+}
+
+// Fields of structs, for parsing values of JSON responses.
+const _structTypes: { [name: string]: { [field: string]: string[] } } = %s
+
+// _parse converts the JSON value v of a result to its type, turning timestamps
+// into Dates.
+function _parse(typewords: string[], v: any): any {
+	if (v === null || v === undefined || typewords.length === 0) {
+		return v
+	}
+	const [t, ...rest] = typewords
+	switch (t) {
+	case 'nullable':
+		return _parse(rest, v)
+	case 'timestamp':
+		return new Date(v)
+	case '[]':
+		return (v as any[]).map(e => _parse(rest, e))
+	case '{}': {
+		const r: { [key: string]: any } = {}
+		for (const k in v) {
+			r[k] = _parse(rest, v[k])
+		}
+		return r
+	}
+	}
+	const fields = _structTypes[t]
+	if (fields) {
+		const r: { [key: string]: any } = { ...v }
+		for (const k in fields) {
+			if (k in v) {
+				r[k] = _parse(fields[k], v[k])
+			}
+		}
+		return r
+	}
+	return v
+}
+
+async function _sherpaCall(baseURL: string, options: ClientOptions, name: string, params: any[], returns: string[][]): Promise<any> {
+	const headers: { [name: string]: string } = { ...options.headers, 'Content-Type': 'application/json' }
+	if (options.csrf) {
+		headers[options.csrf.header] = await _csrfToken(baseURL, options)
+	}
+	let resp: Response
+	try {
+		resp = await fetch(baseURL + name, {
+			method: 'POST',
+			headers: headers,
+			credentials: options.credentials,
+			signal: options.signal,
+			body: JSON.stringify({ params: params }),
+		})
+	} catch (err) {
+		throw new SherpaError('sherpa:http', 'sending request: ' + err)
+	}
+	let body: any = null
+	try {
+		body = await resp.json()
+	} catch (err) {
+		// Handled below.
+	}
+	if (body && body.error) {
+		throw new SherpaError(body.error.code, body.error.message, body.error.details)
+	}
+	if (resp.status === 404) {
+		throw new SherpaError('sherpa:badFunction', 'function does not exist')
+	}
+	if (resp.status !== 200) {
+		throw new SherpaError('sherpa:http', 'HTTP error from server: ' + resp.status)
+	}
+	if (!body || !('result' in body)) {
+		throw new SherpaError('sherpa:badResponse', 'invalid sherpa response, missing result')
+	}
+	if (returns.length === 0) {
+		return undefined
+	}
+	if (returns.length === 1) {
+		return _parse(returns[0], body.result)
+	}
+	return (body.result as any[]).map((v, i) => _parse(returns[i], v))
+}
+`, buf)
+}
+
+// jsString returns s as a quoted JavaScript string.
+func jsString(s string) string {
+	buf, _ := json.Marshal(s)
+	return string(buf)
+}
+
+var reserved = map[string]bool{
+	"break": true, "case": true, "catch": true, "class": true, "const": true, "continue": true,
+	"debugger": true, "default": true, "delete": true, "do": true, "else": true, "enum": true,
+	"export": true, "extends": true, "false": true, "finally": true, "for": true, "function": true,
+	"if": true, "import": true, "in": true, "instanceof": true, "new": true, "null": true,
+	"return": true, "super": true, "switch": true, "this": true, "throw": true, "true": true,
+	"try": true, "typeof": true, "var": true, "void": true, "while": true, "with": true,
+	"let": true, "static": true, "yield": true, "await": true,
+}
+
+// identifier returns a valid TypeScript identifier for name, using "p<index>"
+// for empty names.
+func identifier(name string, index int) string {
+	if name == "" {
+		return fmt.Sprintf("p%d", index)
+	}
+	if reserved[name] {
+		return name + "_"
+	}
+	return name
+}
@@ -0,0 +1,55 @@
+package tsgen
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mjl-/sherpadoc"
+)
+
+func TestGenerate(t *testing.T) {
+	doc := &sherpadoc.Section{
+		Name:    "Example",
+		Version: "1.0.0",
+		Functions: []*sherpadoc.Function{
+			{
+				Name:    "get",
+				Params:  []sherpadoc.Arg{{Name: "id", Typewords: []string{"int64s"}}, {Name: "default", Typewords: []string{"[]", "nullable", "string"}}},
+				Returns: []sherpadoc.Arg{{Name: "item", Typewords: []string{"nullable", "Item"}}},
+			},
+		},
+		Structs: []sherpadoc.Struct{
+			{
+				Name: "Item",
+				Fields: []sherpadoc.Field{
+					{Name: "Tags", Typewords: []string{"{}", "int32"}},
+					{Name: "Created", Typewords: []string{"timestamp"}},
+				},
+			},
+		},
+	}
+
+	var b strings.Builder
+	err := Generate(&b, doc, Opts{ClassName: "Example", Errors: map[string][]string{"get": {"user:notFound"}}})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	s := b.String()
+	for _, exp := range []string{
+		"export interface Item {\n\tTags: { [key: string]: number }\n\tCreated: Date\n}",
+		"export class Example {",
+		"async get(id: string, default_: (string | null)[]): Promise<Item | null> {",
+		`_sherpaCall(this.baseURL, this.options, "get", [id, default_], [["nullable","Item"]]) as Item | null`,
+		"@throws {SherpaError} With code user:notFound.",
+		"headers[options.csrf.header] = await _csrfToken(baseURL, options)",
+	} {
+		if !strings.Contains(s, exp) {
+			t.Fatalf("missing %q in output:\n%s", exp, s)
+		}
+	}
+
+	doc.Functions[0].Returns[0].Typewords = []string{"Bogus"}
+	if err := Generate(&b, doc, Opts{}); err == nil {
+		t.Fatalf("generate with undefined type succeeded")
+	}
+}
@@ -0,0 +1,281 @@
+package sherpa
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/mjl-/sherpadoc"
+)
+
+// validator checks JSON values against the types from sherpadoc documentation.
+type validator struct {
+	functions map[string]*sherpadoc.Function
+	structs   map[string]sherpadoc.Struct
+	ints      map[string]sherpadoc.Ints
+	strings   map[string]sherpadoc.Strings
+}
+
+func newValidator(doc *sherpadoc.Section) *validator {
+	v := &validator{
+		functions: map[string]*sherpadoc.Function{},
+		structs:   map[string]sherpadoc.Struct{},
+		ints:      map[string]sherpadoc.Ints{},
+		strings:   map[string]sherpadoc.Strings{},
+	}
+	v.gather(doc)
+	return v
+}
+
+func (v *validator) gather(sec *sherpadoc.Section) {
+	for _, fn := range sec.Functions {
+		v.functions[fn.Name] = fn
+	}
+	for _, t := range sec.Structs {
+		v.structs[t.Name] = t
+	}
+	for _, t := range sec.Ints {
+		v.ints[t.Name] = t
+	}
+	for _, t := range sec.Strings {
+		v.strings[t.Name] = t
+	}
+	for _, subsec := range sec.Sections {
+		v.gather(subsec)
+	}
+}
+
+// decode parses JSON for validation, keeping numbers as json.Number.
+func decode(buf []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	var x any
+	err := dec.Decode(&x)
+	return x, err
+}
+
+// params validates the JSON-encoded parameters of a call to a function. Functions
+// without documentation are not validated.
+func (v *validator) params(functionName string, params json.RawMessage) error {
+	fn, ok := v.functions[functionName]
+	if !ok {
+		return nil
+	}
+	x, err := decode(params)
+	if err != nil {
+		return err
+	}
+	l, ok := x.([]any)
+	if !ok || len(l) != len(fn.Params) {
+		// Checked elsewhere, e.g. for variadic functions.
+		return nil
+	}
+	for i, arg := range fn.Params {
+		if err := v.check(fmt.Sprintf("params[%d]", i), arg.Typewords, l[i], false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// result validates the result of a call to a function, as returned by
+// handler.call. Functions without documentation are not validated.
+func (v *validator) result(functionName string, result any) error {
+	fn, ok := v.functions[functionName]
+	if !ok || len(fn.Returns) == 0 {
+		return nil
+	}
+	buf, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	x, err := decode(buf)
+	if err != nil {
+		return err
+	}
+	if len(fn.Returns) == 1 {
+		return v.check("result", fn.Returns[0].Typewords, x, true)
+	}
+	l, ok := x.([]any)
+	if !ok || len(l) != len(fn.Returns) {
+		return fmt.Errorf("result: got %d values, expected %d", len(l), len(fn.Returns))
+	}
+	for i, arg := range fn.Returns {
+		if err := v.check(fmt.Sprintf("result[%d]", i), arg.Typewords, l[i], true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check validates value x, as parsed by decode, against typewords. Path is the
+// JSON path to x, used in errors. For results, null is accepted for arrays and
+// objects: Go encodes nil slices and maps as null.
+func (v *validator) check(path string, typewords []string, x any, result bool) error {
+	if len(typewords) == 0 {
+		return nil
+	}
+	if typewords[0] == "nullable" {
+		if x == nil {
+			return nil
+		}
+		typewords = typewords[1:]
+	} else if x == nil && result && (typewords[0] == "[]" || typewords[0] == "{}") {
+		return nil
+	} else if x == nil && typewords[0] != "any" {
+		return fmt.Errorf("%s: null for non-nullable type %v", path, typewords)
+	}
+
+	t := typewords[0]
+	switch t {
+	case "any":
+		return nil
+	case "bool":
+		if _, ok := x.(bool); !ok {
+			return fmt.Errorf("%s: expected bool, got %s", path, jsonKind(x))
+		}
+	case "int8", "int16", "int32", "int64":
+		n, ok := x.(json.Number)
+		if !ok {
+			return fmt.Errorf("%s: expected number for %s, got %s", path, t, jsonKind(x))
+		}
+		if _, err := strconv.ParseInt(string(n), 10, intBits(t)); err != nil {
+			return fmt.Errorf("%s: invalid %s %s", path, t, n)
+		}
+	case "uint8", "uint16", "uint32", "uint64":
+		n, ok := x.(json.Number)
+		if !ok {
+			return fmt.Errorf("%s: expected number for %s, got %s", path, t, jsonKind(x))
+		}
+		if _, err := strconv.ParseUint(string(n), 10, intBits(t)); err != nil {
+			return fmt.Errorf("%s: invalid %s %s", path, t, n)
+		}
+	case "int64s", "uint64s":
+		s, ok := x.(string)
+		if !ok {
+			return fmt.Errorf("%s: expected string for %s, got %s", path, t, jsonKind(x))
+		}
+		var err error
+		if t == "int64s" {
+			_, err = strconv.ParseInt(s, 10, 64)
+		} else {
+			_, err = strconv.ParseUint(s, 10, 64)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: invalid %s %q", path, t, s)
+		}
+	case "float32", "float64":
+		if _, ok := x.(json.Number); !ok {
+			return fmt.Errorf("%s: expected number, got %s", path, jsonKind(x))
+		}
+	case "string":
+		if _, ok := x.(string); !ok {
+			return fmt.Errorf("%s: expected string, got %s", path, jsonKind(x))
+		}
+	case "timestamp":
+		s, ok := x.(string)
+		if !ok {
+			return fmt.Errorf("%s: expected string for timestamp, got %s", path, jsonKind(x))
+		}
+		if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+			return fmt.Errorf("%s: invalid timestamp %q", path, s)
+		}
+	case "[]":
+		l, ok := x.([]any)
+		if !ok {
+			return fmt.Errorf("%s: expected array, got %s", path, jsonKind(x))
+		}
+		for i, e := range l {
+			if err := v.check(fmt.Sprintf("%s[%d]", path, i), typewords[1:], e, result); err != nil {
+				return err
+			}
+		}
+	case "{}":
+		m, ok := x.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: expected object, got %s", path, jsonKind(x))
+		}
+		for k, e := range m {
+			if err := v.check(fmt.Sprintf("%s[%q]", path, k), typewords[1:], e, result); err != nil {
+				return err
+			}
+		}
+	default:
+		if st, ok := v.structs[t]; ok {
+			m, ok := x.(map[string]any)
+			if !ok {
+				return fmt.Errorf("%s: expected object for %s, got %s", path, t, jsonKind(x))
+			}
+			for _, f := range st.Fields {
+				// Missing fields get their zero value.
+				if e, ok := m[f.Name]; ok {
+					if err := v.check(path+"."+f.Name, f.Typewords, e, result); err != nil {
+						return err
+					}
+				}
+			}
+		} else if ints, ok := v.ints[t]; ok {
+			n, ok := x.(json.Number)
+			if !ok {
+				return fmt.Errorf("%s: expected number for %s, got %s", path, t, jsonKind(x))
+			}
+			if len(ints.Values) == 0 {
+				return nil
+			}
+			for _, iv := range ints.Values {
+				if string(n) == strconv.Itoa(iv.Value) {
+					return nil
+				}
+			}
+			return fmt.Errorf("%s: %s is not a value of %s", path, n, t)
+		} else if strs, ok := v.strings[t]; ok {
+			s, ok := x.(string)
+			if !ok {
+				return fmt.Errorf("%s: expected string for %s, got %s", path, t, jsonKind(x))
+			}
+			if len(strs.Values) == 0 {
+				return nil
+			}
+			for _, sv := range strs.Values {
+				if s == sv.Value {
+					return nil
+				}
+			}
+			return fmt.Errorf("%s: %q is not a value of %s", path, s, t)
+		}
+		// Unknown types are not validated.
+	}
+	return nil
+}
+
+func intBits(t string) int {
+	switch t {
+	case "int8", "uint8":
+		return 8
+	case "int16", "uint16":
+		return 16
+	case "int32", "uint32":
+		return 32
+	}
+	return 64
+}
+
+func jsonKind(x any) string {
+	switch x.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", x)
+}
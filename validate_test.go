@@ -0,0 +1,109 @@
+package sherpa
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/mjl-/sherpadoc"
+)
+
+type validateAPI struct {
+}
+
+type Item struct {
+	Name  string
+	Kind  string
+	Count int64 `json:",string"`
+}
+
+func (validateAPI) Add(item Item, n Int64s) Item {
+	if item.Name == "bad" {
+		item.Kind = "bogus"
+	}
+	return item
+}
+
+// List returns nil for a nil slice and map, encoded as null.
+func (validateAPI) List() ([]Item, map[string]Item) {
+	return nil, nil
+}
+
+func TestValidate(t *testing.T) {
+	doc := &sherpadoc.Section{
+		Functions: []*sherpadoc.Function{
+			{
+				Name: "add",
+				Params: []sherpadoc.Arg{
+					{Name: "item", Typewords: []string{"Item"}},
+					{Name: "n", Typewords: []string{"int64s"}},
+				},
+				Returns: []sherpadoc.Arg{
+					{Name: "r", Typewords: []string{"Item"}},
+				},
+			},
+			{
+				Name: "list",
+				Returns: []sherpadoc.Arg{
+					{Name: "l", Typewords: []string{"[]", "Item"}},
+					{Name: "m", Typewords: []string{"{}", "Item"}},
+				},
+			},
+		},
+		Structs: []sherpadoc.Struct{
+			{
+				Name: "Item",
+				Fields: []sherpadoc.Field{
+					{Name: "Name", Typewords: []string{"string"}},
+					{Name: "Kind", Typewords: []string{"Kind"}},
+					{Name: "Count", Typewords: []string{"int64s"}},
+				},
+			},
+		},
+	}
+	kinds := sherpadoc.Strings{Name: "Kind"}
+	kinds.Values = append(kinds.Values, struct {
+		Name  string
+		Value string
+		Docs  string
+	}{"Fruit", "fruit", ""})
+	doc.Strings = []sherpadoc.Strings{kinds}
+
+	h, err := NewHandler("/", "0.0.1", validateAPI{}, doc, &HandlerOpts{ValidateParams: true, ValidateResults: true})
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+
+	test := func(params string, expCode, expPath string) {
+		t.Helper()
+		resp := post(t, h, "/add", `{"params": `+params+`}`)
+		var result struct {
+			Error *Error
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatalf("parsing response: %v", err)
+		}
+		if expCode == "" {
+			if result.Error != nil {
+				t.Fatalf("%s: unexpected error %v", params, result.Error)
+			}
+			return
+		}
+		if result.Error == nil || result.Error.Code != expCode || !strings.Contains(result.Error.Message, expPath+":") {
+			t.Fatalf("%s: got error %v, expected code %q with path %q", params, result.Error, expCode, expPath)
+		}
+	}
+
+	test(`[{"Name": "x", "Kind": "fruit", "Count": "1"}, "2"]`, "", "")
+	test(`[{"Name": "x", "Kind": "fruit"}, 2]`, SherpaBadParams, "params[1]")
+	test(`[{"Name": null, "Kind": "fruit"}, "2"]`, SherpaBadParams, "params[0].Name")
+	test(`[{"Name": "x", "Kind": "veggie"}, "2"]`, SherpaBadParams, "params[0].Kind")
+	test(`[{"Name": "x", "Kind": "fruit", "Count": 1}, "2"]`, SherpaBadParams, "params[0].Count")
+	test(`[null, "2"]`, SherpaBadParams, "params[0]")
+	test(`[{"Name": "bad", "Kind": "fruit"}, "2"]`, SherpaBadResult, "result.Kind")
+
+	resp := post(t, h, "/list", `{"params": []}`)
+	if body := resp.Body.String(); body != `{"result":[null,null]}`+"\n" {
+		t.Fatalf("list: got %q, expected nil slice and map as null", body)
+	}
+}